@@ -521,11 +521,10 @@ Outer:
 		// repositories with these names pointing to other repositories. Using
 		// this method of naming allows the existing repository pulling and
 		// resolution code to do most of the work.
-		rn, err := key(dd.Repository)
+		rn, err := CanonicalURLKey(dd.Repository)
 		if err != nil {
 			return repoNames, err
 		}
-		rn = managerKeyPrefix + rn
 
 		repoNames[dd.Name] = rn
 
@@ -871,6 +870,37 @@ func writeLock(chartpath string, lock *chart.Lock, legacyLockfile bool) error {
 	return os.WriteFile(dest, data, 0644)
 }
 
+// ResolveFileDep returns the absolute path of the local chart directory that a
+// dependency with a file:// repository refers to.
+//
+// Relative paths are resolved against baseDir, which is normally the directory
+// of the chart declaring the dependency. An error is returned if the
+// dependency does not use a file:// repository or if the directory it refers
+// to does not exist.
+func ResolveFileDep(dep *chart.Dependency, baseDir string) (string, error) {
+	if !strings.HasPrefix(dep.Repository, "file://") {
+		return "", errors.Errorf("dependency %s repository %s is not a file:// reference", dep.Name, dep.Repository)
+	}
+
+	p, err := resolver.GetLocalPath(dep.Repository, baseDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve dependency %s", dep.Name)
+	}
+	p, err = filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", errors.Errorf("dependency %s path %s is not a directory", dep.Name, p)
+	}
+	return p, nil
+}
+
 // archive a dep chart from local directory and save it into destPath
 func tarFromLocalDir(chartpath, name, repo, version, destPath string) (string, error) {
 	if !strings.HasPrefix(repo, "file://") {
@@ -908,6 +938,19 @@ func tarFromLocalDir(chartpath, name, repo, version, destPath string) (string, e
 // The prefix to use for cache keys created by the manager for repo names
 const managerKeyPrefix = "helm-manager-"
 
+// CanonicalURLKey returns the repository name the manager generates for a
+// dependency repository that is referenced by URL rather than by name.
+//
+// The name is the managerKeyPrefix followed by the key of the URL, which
+// makes it possible to correlate a URL with the repository cached for it.
+func CanonicalURLKey(url string) (string, error) {
+	k, err := key(url)
+	if err != nil {
+		return "", err
+	}
+	return managerKeyPrefix + k, nil
+}
+
 // key is used to turn a name, such as a repository url, into a filesystem
 // safe name that is unique for querying. To accomplish this a unique hash of
 // the string is used.
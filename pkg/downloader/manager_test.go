@@ -598,3 +598,53 @@ func TestKey(t *testing.T) {
 		}
 	}
 }
+
+func TestCanonicalURLKey(t *testing.T) {
+	o, err := CanonicalURLKey("https://example.com/charts")
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	expect := "helm-manager-7065c57c94b2411ad774638d76823c7ccb56415441f5ab2f5ece2f3845728e5d"
+	if o != expect {
+		t.Errorf("wrong key name generated, expected %q but got %q", expect, o)
+	}
+}
+
+func TestResolveFileDep(t *testing.T) {
+	abs, err := filepath.Abs("testdata/local-subchart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		repo   string
+		expect string
+		err    bool
+	}{
+		{name: "relative path", repo: "file://local-subchart", expect: abs},
+		{name: "absolute path", repo: "file://" + abs, expect: abs},
+		{name: "missing path", repo: "file://does-not-exist", err: true},
+		{name: "archive instead of directory", repo: "file://local-subchart-0.1.0.tgz", err: true},
+		{name: "not a file reference", repo: "https://example.com/charts", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &chart.Dependency{Name: "local-subchart", Repository: tt.repo}
+			p, err := ResolveFileDep(dep, "testdata")
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, got path %s", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, p)
+			}
+		})
+	}
+}
@@ -247,6 +247,24 @@ func (s *Signatory) ClearSign(chartpath string) (string, error) {
 	return out.String(), nil
 }
 
+// DetachSign creates an armored, detached signature of the data read from r.
+//
+// Unlike ClearSign, this signs arbitrary data rather than a chart archive. The
+// Signatory must have a valid Entity.PrivateKey for this to work.
+func (s *Signatory) DetachSign(r io.Reader) (string, error) {
+	if s.Entity == nil {
+		return "", errors.New("private key not found")
+	} else if s.Entity.PrivateKey == nil {
+		return "", errors.New("provided key is not a private key. Try providing a keyring with secret keys")
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := openpgp.ArmoredDetachSign(out, s.Entity, r, &defaultPGPConfig); err != nil {
+		return "", errors.Wrap(err, "failed to sign data")
+	}
+	return out.String(), nil
+}
+
 // Verify checks a signature and verifies that it is legit for a chart.
 func (s *Signatory) Verify(chartpath, sigpath string) (*Verification, error) {
 	ver := &Verification{}
@@ -24,6 +24,7 @@ import (
 	"strings"
 	"testing"
 
+	"golang.org/x/crypto/openpgp"                  //nolint
 	pgperrors "golang.org/x/crypto/openpgp/errors" //nolint
 )
 
@@ -232,6 +233,25 @@ func TestClearSign(t *testing.T) {
 	}
 }
 
+func TestDetachSign(t *testing.T) {
+	signer, err := NewFromFiles(testKeyfile, testPubfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := signer.DetachSign(strings.NewReader(testMessageBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openpgp.CheckArmoredDetachedSignature(signer.KeyRing, strings.NewReader(testMessageBlock), strings.NewReader(sig)); err != nil {
+		t.Errorf("expected signature to verify: %s", err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(signer.KeyRing, strings.NewReader("tampered"), strings.NewReader(sig)); err == nil {
+		t.Error("expected signature not to verify tampered data")
+	}
+}
+
 // failSigner always fails to sign and returns an error
 type failSigner struct{}
 
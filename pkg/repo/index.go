@@ -17,25 +17,47 @@ limitations under the License.
 package repo
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/copystructure"
 	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/crypto/openpgp" //nolint
+	yamlv3 "gopkg.in/yaml.v3"
 	"sigs.k8s.io/yaml"
 
 	"helm.sh/helm/v3/internal/fileutil"
 	"helm.sh/helm/v3/internal/urlutil"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/registry"
 )
 
 var indexPath = "index.yaml"
@@ -43,6 +65,35 @@ var indexPath = "index.yaml"
 // APIVersionV1 is the v1 API version for index and repository files.
 const APIVersionV1 = "v1"
 
+// AnnotationLatestStable is the chart annotation recording the latest stable
+// version of a chart in an index.
+const AnnotationLatestStable = "helm.sh/latest-stable"
+
+// AnnotationReplacedBy is the chart annotation naming the chart that replaces
+// a deprecated chart.
+const AnnotationReplacedBy = "helm.sh/replaced-by"
+
+// AnnotationOS is the chart annotation listing, separated by commas, the
+// operating systems a chart version targets.
+const AnnotationOS = "helm.sh/os"
+
+// AnnotationArch is the chart annotation listing, separated by commas, the
+// architectures a chart version targets.
+const AnnotationArch = "helm.sh/arch"
+
+// AnnotationTrack is the chart annotation naming the release track, such as
+// stable, beta or canary, a chart version is published on.
+const AnnotationTrack = "track"
+
+// AnnotationReleaseNotes is the chart annotation holding the release notes of a
+// chart version. When indexing a directory with IndexDirectoryOptions.RecordNotes
+// set, it takes precedence over a NOTES file in the chart.
+const AnnotationReleaseNotes = "helm.sh/release-notes"
+
+// recommendedAnnotationPrefix prefixes the index annotations recording the
+// recommended version of each chart.
+const recommendedAnnotationPrefix = "recommended/"
+
 var (
 	// ErrNoAPIVersion indicates that an API version was not specified.
 	ErrNoAPIVersion = errors.New("no API version specified")
@@ -54,6 +105,28 @@ var (
 	ErrEmptyIndexYaml = errors.New("empty index.yaml file")
 )
 
+// Reserved versions that ChartVersions.Get and IndexFile.Get resolve to the
+// latest stable version of a chart.
+const (
+	VersionLatest = "latest"
+	VersionStable = "stable"
+)
+
+// ErrInvalidConstraint indicates that a version constraint could not be parsed.
+// Err holds the error returned while parsing Constraint.
+type ErrInvalidConstraint struct {
+	Constraint string
+	Err        error
+}
+
+// Error implements the error interface.
+func (e ErrInvalidConstraint) Error() string {
+	return fmt.Sprintf("invalid version constraint %q: %s", e.Constraint, e.Err)
+}
+
+// Unwrap returns the underlying parse error.
+func (e ErrInvalidConstraint) Unwrap() error { return e.Err }
+
 // ChartVersions is a list of versioned chart references.
 // Implements a sorter on Version.
 type ChartVersions []*ChartVersion
@@ -78,6 +151,240 @@ func (c ChartVersions) Less(a, b int) bool {
 	return i.LessThan(j)
 }
 
+// Get returns the first chart version, in list order, that satisfies the given
+// version constraint. On sorted versions this is the newest one. A version
+// exactly equal to the constraint string takes precedence.
+//
+// If version is empty, this will return the chart with the latest stable version,
+// prerelease versions will be skipped. The reserved versions "latest" and
+// "stable" are treated the same as an empty version, unless a chart version
+// with exactly that name exists. ErrInvalidConstraint is returned if the
+// constraint cannot be parsed, and ErrNoChartVersion if no version satisfies it.
+func (c ChartVersions) Get(version string) (*ChartVersion, error) {
+	if len(c) == 0 {
+		return nil, ErrNoChartVersion
+	}
+
+	var constraint *semver.Constraints
+	if version == "" || version == VersionLatest || version == VersionStable {
+		constraint, _ = semver.NewConstraint("*")
+	} else {
+		var err error
+		constraint, err = semver.NewConstraint(version)
+		if err != nil {
+			return nil, ErrInvalidConstraint{Constraint: version, Err: err}
+		}
+	}
+
+	// when customer input exact version, check whether have exact match one first
+	if len(version) != 0 {
+		for _, ver := range c {
+			if version == ver.Version {
+				return ver, nil
+			}
+		}
+	}
+
+	for _, ver := range c {
+		test, err := semver.NewVersion(ver.Version)
+		if err != nil {
+			continue
+		}
+
+		if constraint.Check(test) {
+			return ver, nil
+		}
+	}
+	return nil, ErrNoChartVersion
+}
+
+// Newer returns all versions strictly greater than the given version, sorted
+// in descending order.
+//
+// Entries whose version cannot be parsed are skipped.
+func (c ChartVersions) Newer(than string) (ChartVersions, error) {
+	base, err := semver.NewVersion(than)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version %q", than)
+	}
+
+	var newer ChartVersions
+	for _, cv := range c {
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil {
+			continue
+		}
+		if v.GreaterThan(base) {
+			newer = append(newer, cv)
+		}
+	}
+	sort.Sort(sort.Reverse(newer))
+	return newer, nil
+}
+
+// Previous returns the highest stable version strictly less than the given
+// version.
+//
+// Prerelease versions and entries whose version cannot be parsed are skipped.
+// ErrNoChartVersion is returned when no earlier stable version exists.
+func (c ChartVersions) Previous(version string) (*ChartVersion, error) {
+	base, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version %q", version)
+	}
+
+	var previous *ChartVersion
+	var previousVersion *semver.Version
+	for _, cv := range c {
+		if cv == nil || cv.Metadata == nil {
+			continue
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil || v.Prerelease() != "" || !v.LessThan(base) {
+			continue
+		}
+		if previousVersion == nil || v.GreaterThan(previousVersion) {
+			previous, previousVersion = cv, v
+		}
+	}
+	if previous == nil {
+		return nil, ErrNoChartVersion
+	}
+	return previous, nil
+}
+
+// UpgradePath returns, in ascending order, the versions to step through when
+// upgrading from one version to another: the stable versions strictly greater
+// than from, up to and including to.
+//
+// Prerelease versions are skipped, except for to itself, and so are entries
+// whose version cannot be parsed. An error is returned if either version is
+// invalid, if to is not greater than from, or if no entry has version to.
+func (c ChartVersions) UpgradePath(from, to string) (ChartVersions, error) {
+	start, err := semver.NewVersion(from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version %q", from)
+	}
+	end, err := semver.NewVersion(to)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version %q", to)
+	}
+	if !end.GreaterThan(start) {
+		return nil, errors.Errorf("version %s is not newer than %s", to, from)
+	}
+
+	var path ChartVersions
+	found := false
+	for _, cv := range c {
+		if cv == nil || cv.Metadata == nil {
+			continue
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil || !v.GreaterThan(start) || v.GreaterThan(end) {
+			continue
+		}
+		if v.Equal(end) {
+			if found {
+				continue
+			}
+			found = true
+		} else if v.Prerelease() != "" {
+			continue
+		}
+		path = append(path, cv)
+	}
+	if !found {
+		return nil, errors.Errorf("no chart version found for %s", to)
+	}
+	sort.Sort(path)
+	return path, nil
+}
+
+// GetByTrack returns the highest version published on the given release track,
+// as recorded in the AnnotationTrack annotation.
+//
+// Prerelease versions are considered. Entries whose version cannot be parsed
+// are skipped. ErrNoChartVersion is returned when no version is on the track.
+func (c ChartVersions) GetByTrack(track string) (*ChartVersion, error) {
+	var best *ChartVersion
+	var bestVersion *semver.Version
+	for _, cv := range c {
+		if cv == nil || cv.Metadata == nil || cv.Annotations[AnnotationTrack] != track {
+			continue
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil {
+			continue
+		}
+		if bestVersion == nil || v.GreaterThan(bestVersion) {
+			best, bestVersion = cv, v
+		}
+	}
+	if best == nil {
+		return nil, ErrNoChartVersion
+	}
+	return best, nil
+}
+
+// GetByAppVersion returns the highest chart version whose appVersion satisfies
+// the given semver constraint.
+//
+// Entries whose appVersion or version cannot be parsed are skipped.
+// ErrNoChartVersion is returned when no entry matches.
+func (c ChartVersions) GetByAppVersion(appVersionConstraint string) (*ChartVersion, error) {
+	constraint, err := semver.NewConstraint(appVersionConstraint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid appVersion constraint %q", appVersionConstraint)
+	}
+
+	var best *ChartVersion
+	var bestVersion *semver.Version
+	for _, cv := range c {
+		if cv == nil || cv.Metadata == nil {
+			continue
+		}
+		appVersion, err := semver.NewVersion(cv.AppVersion)
+		if err != nil || !constraint.Check(appVersion) {
+			continue
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil {
+			continue
+		}
+		if bestVersion == nil || v.GreaterThan(bestVersion) {
+			best, bestVersion = cv, v
+		}
+	}
+	if best == nil {
+		return nil, ErrNoChartVersion
+	}
+	return best, nil
+}
+
+// GetByDigest returns the chart version whose digest matches the given one.
+//
+// Digests are compared case-insensitively and with or without a "sha256:"
+// prefix. ErrNoChartVersion is returned when no entry matches.
+func (c ChartVersions) GetByDigest(digest string) (*ChartVersion, error) {
+	want := normalizeDigest(digest)
+	if want == "" {
+		return nil, ErrNoChartVersion
+	}
+	for _, cv := range c {
+		if cv != nil && normalizeDigest(cv.Digest) == want {
+			return cv, nil
+		}
+	}
+	return nil, ErrNoChartVersion
+}
+
+// normalizeDigest returns the digest in lowercase, without its "sha256:"
+// algorithm prefix.
+func normalizeDigest(digest string) string {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
 // IndexFile represents the index file in a chart repository
 type IndexFile struct {
 	// This is used ONLY for validation against chartmuseum's index files and is discarded after validation.
@@ -90,16 +397,89 @@ type IndexFile struct {
 	// Annotations are additional mappings uninterpreted by Helm. They are made available for
 	// other applications to add information to the index file.
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Include lists other index files to merge into this one. It is only
+	// honored by LoadIndexFileWithIncludes.
+	Include []string `json:"include,omitempty"`
+
+	// SemverOptions configures how versions are compared when looking up
+	// entries. It is not part of the index file.
+	SemverOptions SemverOptions `json:"-"`
+
+	// now returns the current time. If nil, time.Now is used.
+	now func() time.Time
+}
+
+// ServerInfo holds the fields Helm knows of in the serverInfo section that
+// ChartMuseum adds to the indices it serves.
+type ServerInfo struct {
+	// Present is true if the index has a serverInfo section at all.
+	Present bool
+	// ContextPath is the path prefix ChartMuseum is served under, such as
+	// "/v1/helm".
+	ContextPath string
+	// Version is the ChartMuseum version, if advertised.
+	Version string
+}
+
+// ParseServerInfo returns the known fields of the ServerInfo section of the
+// index. Fields that are missing or not strings are left empty. The ServerInfo
+// map itself is left as is.
+func (i IndexFile) ParseServerInfo() ServerInfo {
+	info := ServerInfo{Present: i.ServerInfo != nil}
+	info.ContextPath, _ = i.ServerInfo["contextPath"].(string)
+	info.Version, _ = i.ServerInfo["version"].(string)
+	return info
+}
+
+// IndexFileOption configures an IndexFile created by NewIndexFileWithOptions.
+type IndexFileOption func(*IndexFile)
+
+// WithClock sets the function the index uses to tell the current time, for its
+// Generated time and the Created time of entries added with MustAdd. It
+// defaults to time.Now.
+func WithClock(now func() time.Time) IndexFileOption {
+	return func(i *IndexFile) {
+		i.now = now
+	}
+}
+
+// currentTime returns the current time according to the clock of the index.
+func (i IndexFile) currentTime() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+// SemverOptions configures how an IndexFile compares chart versions.
+type SemverOptions struct {
+	// DistinguishBuildMetadata makes Get, Has and Merge treat versions that
+	// differ only in their build metadata, such as 1.0.0+linux and
+	// 1.0.0+windows, as different versions. It applies when the requested
+	// version is a complete semantic version rather than a range. By default,
+	// build metadata is ignored as the semver specification prescribes.
+	DistinguishBuildMetadata bool
 }
 
 // NewIndexFile initializes an index.
 func NewIndexFile() *IndexFile {
-	return &IndexFile{
+	return NewIndexFileWithOptions()
+}
+
+// NewIndexFileWithOptions initializes an index, like NewIndexFile, configured
+// with the given options.
+func NewIndexFileWithOptions(opts ...IndexFileOption) *IndexFile {
+	i := &IndexFile{
 		APIVersion: APIVersionV1,
-		Generated:  time.Now(),
 		Entries:    map[string]ChartVersions{},
 		PublicKeys: []string{},
 	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	i.Generated = i.currentTime()
+	return i
 }
 
 // LoadIndexFile takes a file at the given path and returns an IndexFile object
@@ -115,156 +495,2699 @@ func LoadIndexFile(path string) (*IndexFile, error) {
 	return i, nil
 }
 
-// MustAdd adds a file to the index
-// This can leave the index in an unsorted state
-func (i IndexFile) MustAdd(md *chart.Metadata, filename, baseURL, digest string) error {
-	if i.Entries == nil {
-		return errors.New("entries not initialized")
+// LoadIndexFileWithIncludes is like LoadIndexFile, but also loads the index
+// files listed under the include field and merges them into the result.
+//
+// Includes are local paths, optionally prefixed with file://, and relative
+// paths are resolved against the directory of the including file. Included
+// files may include further files. Entries already present are kept, so the
+// including file takes priority over the files it includes, and earlier
+// includes over later ones. An include cycle results in an error.
+//
+// The Include field of the returned index is cleared, as its includes have
+// been resolved.
+func LoadIndexFileWithIncludes(path string) (*IndexFile, error) {
+	return loadIndexFileWithIncludes(path, map[string]bool{})
+}
+
+// loadIndexFileWithIncludes loads the index at path and its includes. The
+// loading map holds the files currently being loaded, to detect cycles.
+func loadIndexFileWithIncludes(path string, loading map[string]bool) (*IndexFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if loading[abs] {
+		return nil, errors.Errorf("include cycle detected at %s", path)
 	}
+	loading[abs] = true
+	defer delete(loading, abs)
 
-	if md.APIVersion == "" {
-		md.APIVersion = chart.APIVersionV1
+	i, err := LoadIndexFile(abs)
+	if err != nil {
+		return nil, err
 	}
-	if err := md.Validate(); err != nil {
-		return errors.Wrapf(err, "validate failed for %s", filename)
+	includes := i.Include
+	i.Include = nil
+	for _, inc := range includes {
+		if strings.Contains(inc, "://") && !strings.HasPrefix(inc, "file://") {
+			return nil, errors.Errorf("unsupported include %q in %s: only local files can be included", inc, path)
+		}
+		p := strings.TrimPrefix(inc, "file://")
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(abs), p)
+		}
+		included, err := loadIndexFileWithIncludes(p, loading)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error including %q in %s", inc, path)
+		}
+		i.Merge(included)
 	}
+	i.SortEntries()
+	return i, nil
+}
 
-	u := filename
-	if baseURL != "" {
-		_, file := filepath.Split(filename)
-		var err error
-		u, err = urlutil.URLJoin(baseURL, file)
+// LoadIndexFileRepair is like LoadIndexFile, but repairs indices in which the
+// same chart name appears as more than one key under entries, as produced by
+// naively concatenating index files.
+//
+// The version lists of duplicate keys are concatenated under the first key.
+// A note describing each repair is returned along with the index.
+func LoadIndexFileRepair(path string) (*IndexFile, []string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, notes, err := repairDuplicateEntries(b)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error repairing %s", path)
+	}
+	i, err := loadIndex(b, path)
+	if err != nil {
+		return nil, notes, errors.Wrapf(err, "error loading %s", path)
+	}
+	return i, notes, nil
+}
+
+// repairDuplicateEntries merges chart names that appear as more than one key
+// under the top-level entries key of an index.
+//
+// If nothing needs repairing, the data is returned unchanged.
+func repairDuplicateEntries(data []byte) ([]byte, []string, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return data, nil, nil
+	}
+
+	var notes []string
+	root := doc.Content[0]
+	for k := 0; k+1 < len(root.Content); k += 2 {
+		if root.Content[k].Value != "entries" || root.Content[k+1].Kind != yamlv3.MappingNode {
+			continue
+		}
+		entries := root.Content[k+1]
+		first := map[string]*yamlv3.Node{}
+		kept := entries.Content[:0]
+		for e := 0; e+1 < len(entries.Content); e += 2 {
+			key, value := entries.Content[e], entries.Content[e+1]
+			prev, ok := first[key.Value]
+			if !ok {
+				first[key.Value] = value
+				kept = append(kept, key, value)
+				continue
+			}
+			if prev.Kind != yamlv3.SequenceNode || value.Kind != yamlv3.SequenceNode {
+				return nil, nil, errors.Errorf("cannot merge duplicate entries for chart %q", key.Value)
+			}
+			prev.Content = append(prev.Content, value.Content...)
+			notes = append(notes, fmt.Sprintf("merged %d duplicate entries for chart %q (line %d)", len(value.Content), key.Value, key.Line))
+		}
+		entries.Content = kept
+	}
+
+	if len(notes) == 0 {
+		return data, nil, nil
+	}
+	out, err := yamlv3.Marshal(&doc)
+	return out, notes, err
+}
+
+// PeekLatest returns the latest stable version of the named chart from the
+// index file at path, without loading the whole index.
+//
+// The file is read only up to the end of the chart's entries, and only those
+// entries are decoded. YAML indices are expected to be laid out the way
+// WriteFile writes them; when the top-level entries key cannot be found, the
+// whole index is loaded instead. ErrNoChartName is returned when the chart is
+// not in the index.
+func PeekLatest(path, chartName string) (*ChartVersion, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var cvs ChartVersions
+	var found bool
+	if isJSON, err := startsWithJSONObject(r); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", path)
+	} else if isJSON {
+		cvs, found, err = peekJSONEntries(r, chartName)
 		if err != nil {
-			u = path.Join(baseURL, file)
+			return nil, errors.Wrapf(err, "error reading %s", path)
+		}
+	} else {
+		var hasEntries bool
+		cvs, found, hasEntries, err = peekYAMLEntries(r, chartName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", path)
+		}
+		if !hasEntries {
+			i, err := LoadIndexFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return i.Get(chartName, "")
+		}
+	}
+	if !found {
+		return nil, ErrNoChartName
+	}
+
+	var valid ChartVersions
+	for _, cv := range cvs {
+		if cv == nil {
+			continue
+		}
+		if cv.Metadata == nil {
+			cv.Metadata = &chart.Metadata{}
+		}
+		if cv.APIVersion == "" {
+			cv.APIVersion = chart.APIVersionV1
+		}
+		if err := cv.Validate(); ignoreSkippableChartValidationError(err) != nil {
+			log.Printf("skipping loading invalid entry for chart %q %q from %s: %s", chartName, cv.Version, path, err)
+			continue
+		}
+		valid = append(valid, cv)
+	}
+	sort.Sort(sort.Reverse(valid))
+	i := IndexFile{Entries: map[string]ChartVersions{chartName: valid}}
+	return i.Get(chartName, "")
+}
+
+// startsWithJSONObject reports whether the first non-whitespace byte read from
+// r opens a JSON object, without consuming it.
+func startsWithJSONObject(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '{', nil
+		}
+	}
+}
+
+// peekJSONEntries decodes the entries of the named chart from a JSON index,
+// skipping over every other value.
+func peekJSONEntries(r io.Reader, chartName string) (ChartVersions, bool, error) {
+	dec := json.NewDecoder(r)
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return nil, false, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		if key != "entries" {
+			if err := skipJSONValue(dec); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if err := expectJSONDelim(dec, '{'); err != nil {
+			return nil, false, err
+		}
+		for dec.More() {
+			name, err := dec.Token()
+			if err != nil {
+				return nil, false, err
+			}
+			if name == chartName {
+				var cvs ChartVersions
+				err := dec.Decode(&cvs)
+				return cvs, err == nil, err
+			}
+			if err := skipJSONValue(dec); err != nil {
+				return nil, false, err
+			}
+		}
+		return nil, false, nil
+	}
+	return nil, false, nil
+}
+
+// expectJSONDelim reads the next token from dec and fails unless it is the
+// given delimiter.
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return errors.Errorf("expected %q, got %v", delim, t)
+	}
+	return nil
+}
+
+// skipJSONValue reads and discards the next complete value from dec.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// peekYAMLEntries extracts and decodes the entries of the named chart from a
+// YAML index, reading line by line.
+//
+// hasEntries is false when no top-level entries key was found, in which case
+// the layout of the index is not understood and nothing was decoded.
+func peekYAMLEntries(r *bufio.Reader, chartName string) (cvs ChartVersions, found, hasEntries bool, err error) {
+	var block strings.Builder
+	childIndent := -1
+	inChart := false
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, false, hasEntries, readErr
+		}
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			if inChart {
+				block.WriteString(line)
+			}
+		case !hasEntries:
+			hasEntries = indent == 0 && strings.TrimRight(line, " \r\n") == "entries:"
+		case indent == 0:
+			readErr = io.EOF
+		case childIndent < 0 || indent == childIndent && !strings.HasPrefix(trimmed, "-"):
+			if inChart {
+				readErr = io.EOF
+				break
+			}
+			childIndent = indent
+			key, _, _ := strings.Cut(trimmed, ":")
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				key = unquoted
+			} else {
+				key = strings.Trim(key, "'")
+			}
+			if key == chartName {
+				inChart = true
+				block.WriteString(line[childIndent:])
+			}
+		case inChart:
+			if indent < childIndent {
+				readErr = io.EOF
+				break
+			}
+			block.WriteString(line[childIndent:])
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if !inChart {
+		return nil, false, hasEntries, nil
+	}
+	var entries map[string]ChartVersions
+	if err := yamlUnmarshalStrict([]byte(block.String()), &entries); err != nil {
+		return nil, false, true, err
+	}
+	for _, v := range entries {
+		return v, true, true, nil
+	}
+	return nil, false, true, nil
+}
+
+// LoadIndexFromResponse reads an index from the body of an HTTP response.
+//
+// The Content-Encoding header decides whether the body is decompressed, which
+// is needed when the transport did not already do so, such as when the request
+// set Accept-Encoding itself. Only gzip is supported. The Content-Type header
+// decides whether the body is parsed as JSON or YAML.
+// When the content type is missing or not recognized, the format is detected
+// from the data the same way LoadIndexFile does. The caller remains
+// responsible for closing the response body.
+func LoadIndexFromResponse(resp *http.Response) (*IndexFile, error) {
+	if resp == nil || resp.Body == nil {
+		return nil, errors.New("no response body to load index from")
+	}
+	source := "HTTP response"
+	if resp.Request != nil && resp.Request.URL != nil {
+		source = resp.Request.URL.String()
+	}
+
+	// Encodings are listed in the order they were applied, so they are undone
+	// in reverse.
+	var body io.Reader = resp.Body
+	encodings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	for idx := len(encodings) - 1; idx >= 0; idx-- {
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[idx])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error decompressing index from %s", source)
+			}
+			defer gz.Close()
+			body = gz
+		default:
+			return nil, errors.Errorf("unsupported content encoding %q for index from %s", enc, source)
+		}
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading index from %s", source)
+	}
+
+	unmarshal := jsonOrYamlUnmarshal
+	if mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		switch {
+		case mediatype == "application/json" || strings.HasSuffix(mediatype, "+json"):
+			unmarshal = json.Unmarshal
+		case isYAMLMediaType(mediatype):
+			unmarshal = yamlUnmarshalStrict
+		}
+	}
+
+	i, err := loadIndexWith(b, source, unmarshal)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading %s", source)
+	}
+	return i, nil
+}
+
+// IndexTransport fetches the raw data of an index file for LoadIndexFromURL.
+type IndexTransport interface {
+	Fetch(ctx context.Context, u *url.URL) ([]byte, error)
+}
+
+// IndexTransportFunc is a function that implements IndexTransport.
+type IndexTransportFunc func(ctx context.Context, u *url.URL) ([]byte, error)
+
+// Fetch calls f(ctx, u).
+func (f IndexTransportFunc) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	return f(ctx, u)
+}
+
+// defaultIndexTransports are the transports LoadIndexFromURL uses for schemes
+// the caller did not register a transport for.
+var defaultIndexTransports = map[string]IndexTransport{
+	"http":  IndexTransportFunc(fetchHTTPIndex),
+	"https": IndexTransportFunc(fetchHTTPIndex),
+	"file":  IndexTransportFunc(fetchFileIndex),
+}
+
+// LoadIndexFromURL fetches the index file at rawurl with the transport
+// registered in transports for its scheme, and loads it the same way
+// LoadIndexFile does. Transports for http, https and file URLs are built in,
+// and can be replaced by registering a transport for their scheme.
+func LoadIndexFromURL(ctx context.Context, rawurl string, transports map[string]IndexTransport) (*IndexFile, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid index URL %q", rawurl)
+	}
+	transport, ok := transports[u.Scheme]
+	if !ok {
+		transport, ok = defaultIndexTransports[u.Scheme]
+	}
+	if !ok {
+		return nil, errors.Errorf("no index transport registered for scheme %q", u.Scheme)
+	}
+
+	b, err := transport.Fetch(ctx, u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching index from %s", rawurl)
+	}
+	i, err := loadIndex(b, rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading %s", rawurl)
+	}
+	return i, nil
+}
+
+// fetchHTTPIndex fetches an index file with the default HTTP client.
+func fetchHTTPIndex(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchFileIndex reads an index file from the local file system.
+func fetchFileIndex(ctx context.Context, u *url.URL) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.FromSlash(u.Path))
+}
+
+// isYAMLMediaType reports whether the given media type is commonly used to
+// serve YAML documents.
+func isYAMLMediaType(mediatype string) bool {
+	switch mediatype {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return strings.HasSuffix(mediatype, "+yaml")
+}
+
+// MustAdd adds a file to the index
+// This can leave the index in an unsorted state
+func (i IndexFile) MustAdd(md *chart.Metadata, filename, baseURL, digest string) error {
+	if i.Entries == nil {
+		return errors.New("entries not initialized")
+	}
+
+	if md.APIVersion == "" {
+		md.APIVersion = chart.APIVersionV1
+	}
+	if err := md.Validate(); err != nil {
+		return errors.Wrapf(err, "validate failed for %s", filename)
+	}
+
+	u := filename
+	if baseURL != "" {
+		_, file := filepath.Split(filename)
+		var err error
+		u, err = urlutil.URLJoin(baseURL, file)
+		if err != nil {
+			u = path.Join(baseURL, file)
+		}
+	}
+	cr := &ChartVersion{
+		URLs:     []string{u},
+		Metadata: md,
+		Digest:   digest,
+		Created:  i.currentTime(),
+	}
+	ee := i.Entries[md.Name]
+	i.Entries[md.Name] = append(ee, cr)
+	return nil
+}
+
+// Add adds a file to the index and logs an error.
+//
+// Deprecated: Use index.MustAdd instead.
+func (i IndexFile) Add(md *chart.Metadata, filename, baseURL, digest string) {
+	if err := i.MustAdd(md, filename, baseURL, digest); err != nil {
+		log.Printf("skipping loading invalid entry for chart %q %q from %s: %s", md.Name, md.Version, filename, err)
+	}
+}
+
+// Has returns true if the index has an entry for a chart with the given name and exact version.
+func (i IndexFile) Has(name, version string) bool {
+	_, err := i.Get(name, version)
+	return err == nil
+}
+
+// CanSatisfy returns true if any version of the named chart satisfies the
+// given semver constraint. Unlike Get, an unknown chart or an invalid
+// constraint is not an error; both simply report false.
+func (i IndexFile) CanSatisfy(name, constraint string) bool {
+	_, err := i.Get(name, constraint)
+	return err == nil
+}
+
+// HasChart returns true if the index has at least one entry for a chart with the
+// given name, regardless of its version.
+func (i IndexFile) HasChart(name string) bool {
+	return len(i.Entries[name]) > 0
+}
+
+// SortEntries sorts the entries by version in descending order.
+//
+// In canonical form, the individual version records should be sorted so that
+// the most recent release for every version is in the 0th slot in the
+// Entries.ChartVersions array. That way, tooling can predict the newest
+// version without needing to parse SemVers.
+func (i IndexFile) SortEntries() {
+	i.SortEntriesBy(SortSemverDesc)
+}
+
+// SortOrder is an order in which the versions of each chart can be sorted.
+type SortOrder int
+
+const (
+	// SortSemverDesc sorts versions from the highest to the lowest version.
+	SortSemverDesc SortOrder = iota
+	// SortSemverAsc sorts versions from the lowest to the highest version.
+	SortSemverAsc
+	// SortCreatedDesc sorts versions from the most to the least recently created.
+	SortCreatedDesc
+	// SortCreatedAsc sorts versions from the least to the most recently created.
+	SortCreatedAsc
+)
+
+// SortEntriesBy sorts the versions of each chart in the given order.
+//
+// For the semver orders, versions that cannot be parsed are moved to the back.
+// Only SortSemverDesc produces the canonical form described on SortEntries.
+func (i IndexFile) SortEntriesBy(order SortOrder) {
+	for _, versions := range i.Entries {
+		switch order {
+		case SortSemverAsc:
+			sort.Sort(semverAscending{versions})
+		case SortCreatedDesc:
+			sort.SliceStable(versions, func(a, b int) bool {
+				return versions[a].Created.After(versions[b].Created)
+			})
+		case SortCreatedAsc:
+			sort.SliceStable(versions, func(a, b int) bool {
+				return versions[a].Created.Before(versions[b].Created)
+			})
+		default:
+			sort.Sort(sort.Reverse(versions))
+		}
+	}
+}
+
+// IsSorted reports whether the versions of every chart in the index are in the
+// descending order produced by SortEntries, as compared by ChartVersions.Less.
+//
+// Versions that cannot be parsed are expected after all other versions, in any
+// order among themselves.
+func (i IndexFile) IsSorted() bool {
+	for _, cvs := range i.Entries {
+		for idx := 1; idx < len(cvs); idx++ {
+			if cvs.Less(idx-1, idx) && !cvs.Less(idx, idx-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// semverAscending sorts chart versions in ascending order, moving versions
+// that cannot be parsed to the back.
+type semverAscending struct {
+	ChartVersions
+}
+
+func (c semverAscending) Less(a, b int) bool {
+	i, err := semver.NewVersion(c.ChartVersions[a].Version)
+	if err != nil {
+		return false
+	}
+	j, err := semver.NewVersion(c.ChartVersions[b].Version)
+	if err != nil {
+		return true
+	}
+	return i.LessThan(j)
+}
+
+// Get returns the ChartVersion for the given name.
+//
+// If version is empty, or one of the reserved versions VersionLatest and
+// VersionStable, this will return the chart with the latest stable version,
+// prerelease versions will be skipped. An invalid version constraint results in
+// an ErrInvalidConstraint.
+func (i IndexFile) Get(name, version string) (*ChartVersion, error) {
+	vs, ok := i.Entries[name]
+	if !ok {
+		return nil, ErrNoChartName
+	}
+	if len(vs) == 0 {
+		return nil, ErrNoChartVersion
+	}
+
+	if i.SemverOptions.DistinguishBuildMetadata {
+		if want, err := semver.StrictNewVersion(version); err == nil {
+			for _, ver := range vs {
+				test, err := semver.NewVersion(ver.Version)
+				if err == nil && test.Equal(want) && test.Metadata() == want.Metadata() {
+					return ver, nil
+				}
+			}
+			return nil, errors.Errorf("no chart version found for %s-%s", name, version)
+		}
+	}
+
+	cv, err := vs.Get(version)
+	if err == ErrNoChartVersion {
+		return nil, errors.Errorf("no chart version found for %s-%s", name, version)
+	}
+	return cv, err
+}
+
+// GetByTrack returns the highest version of the named chart published on the
+// given release track. See ChartVersions.GetByTrack.
+func (i IndexFile) GetByTrack(name, track string) (*ChartVersion, error) {
+	vs, ok := i.Entries[name]
+	if !ok {
+		return nil, ErrNoChartName
+	}
+	return vs.GetByTrack(track)
+}
+
+// ReleaseNotes returns the release notes recorded for the given version of the
+// named chart, which may be empty.
+func (i IndexFile) ReleaseNotes(name, version string) (string, error) {
+	cv, err := i.Get(name, version)
+	if err != nil {
+		return "", err
+	}
+	return cv.Notes, nil
+}
+
+// GetByDigest returns the version of the named chart whose digest matches the
+// given one. See ChartVersions.GetByDigest for how digests are compared.
+func (i IndexFile) GetByDigest(name, digest string) (*ChartVersion, error) {
+	vs, ok := i.Entries[name]
+	if !ok {
+		return nil, ErrNoChartName
+	}
+	return vs.GetByDigest(digest)
+}
+
+// WriteFile writes an index file to the given destination path.
+//
+// The mode on the file is set to 'mode'.
+func (i IndexFile) WriteFile(dest string, mode os.FileMode) error {
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(dest, bytes.NewReader(b), mode)
+}
+
+// WriteFileWithGenerated is like WriteFile, but records generated as the time
+// the index was generated instead of its Generated field, which is left
+// unchanged. Along with sorted entries, a fixed time such as one taken from
+// SOURCE_DATE_EPOCH makes the written file reproducible.
+func (i IndexFile) WriteFileWithGenerated(dest string, mode os.FileMode, generated time.Time) error {
+	i.Generated = generated
+	return i.WriteFile(dest, mode)
+}
+
+// Keyring parses the ASCII-armored keys in PublicKeys into a keyring that can
+// be used to verify signatures, such as those written by WriteSignedFile. The
+// error for a malformed key identifies it by its position in PublicKeys.
+func (i IndexFile) Keyring() (openpgp.EntityList, error) {
+	var ring openpgp.EntityList
+	for idx, key := range i.PublicKeys {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse public key %d in index", idx)
+		}
+		ring = append(ring, entities...)
+	}
+	return ring, nil
+}
+
+// Sign returns an armored, detached PGP signature of the index as marshaled by
+// WriteFile, made with the key named keyName in the given keyring file.
+//
+// The key must not be protected by a passphrase.
+func (i IndexFile) Sign(keyring, keyName string) ([]byte, error) {
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	return signIndex(b, keyring, keyName)
+}
+
+// WriteSignedFile writes the index file to dest, like WriteFile, and its
+// detached signature, as made by Sign, to dest with a ".prov" extension
+// appended. Both files are created with the given mode.
+func (i IndexFile) WriteSignedFile(dest string, mode os.FileMode, keyring, keyName string) error {
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+	sig, err := signIndex(b, keyring, keyName)
+	if err != nil {
+		return err
+	}
+	if err := fileutil.AtomicWriteFile(dest, bytes.NewReader(b), mode); err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(dest+".prov", bytes.NewReader(sig), mode)
+}
+
+// signIndex signs the marshaled index b with the named key from keyring.
+func signIndex(b []byte, keyring, keyName string) ([]byte, error) {
+	signer, err := provenance.NewFromKeyring(keyring, keyName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load signing key")
+	}
+	sig, err := signer.DetachSign(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign index")
+	}
+	return []byte(sig), nil
+}
+
+// WriteJSONFile writes an index file in JSON format to the given destination
+// path.
+//
+// The mode on the file is set to 'mode'.
+func (i IndexFile) WriteJSONFile(dest string, mode os.FileMode) error {
+	b, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(dest, bytes.NewReader(b), mode)
+}
+
+// WriteJSONL writes the entries of the index to w as JSON Lines, one chart
+// version per line.
+//
+// Each object carries the name the chart is indexed under in a "chart" field.
+// Charts are written in name order and versions in descending order. The
+// index itself is not modified.
+func (i IndexFile) WriteJSONL(w io.Writer) error {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc := json.NewEncoder(w)
+	for _, name := range names {
+		cvs := append(ChartVersions{}, i.Entries[name]...)
+		sort.Stable(sort.Reverse(cvs))
+		for _, cv := range cvs {
+			if cv == nil {
+				continue
+			}
+			entry := struct {
+				Chart string `json:"chart"`
+				*ChartVersion
+			}{name, cv}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the index to w in the same YAML form as WriteFile, and
+// returns the number of bytes written. It implements io.WriterTo.
+//
+// Rather than marshaling the whole index at once, the entries are marshaled
+// and written one chart at a time, in name order, so only a single chart's
+// output is buffered at any point.
+func (i IndexFile) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := i.Entries
+	return i.writeEntries(w, names, func(name string) (ChartVersions, error) {
+		return entries[name], nil
+	})
+}
+
+// writeEntries writes the index to w like WriteTo, but with the charts listed
+// in names, in that order, as its entries instead of those in Entries. The
+// versions of each chart are only obtained from load when they are written.
+func (i IndexFile) writeEntries(w io.Writer, names []string, load func(name string) (ChartVersions, error)) (int64, error) {
+	var written int64
+	write := func(b []byte) error {
+		n, err := w.Write(b)
+		written += int64(n)
+		return err
+	}
+
+	i.Entries = map[string]ChartVersions{}
+	header, err := yaml.Marshal(i)
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 0 {
+		return written, write(header)
+	}
+
+	// Top-level keys are marshaled in order, so the entries go where the
+	// placeholder for the empty map is.
+	const placeholder = "entries: {}\n"
+	at := 0
+	if !bytes.HasPrefix(header, []byte(placeholder)) {
+		at = bytes.Index(header, []byte("\n"+placeholder)) + 1
+		if at == 0 {
+			return 0, errors.New("unable to locate entries in marshaled index")
+		}
+	}
+	if err := write(header[:at]); err != nil {
+		return written, err
+	}
+	if err := write([]byte("entries:\n")); err != nil {
+		return written, err
+	}
+
+	for _, name := range names {
+		cvs, err := load(name)
+		if err != nil {
+			return written, err
+		}
+		b, err := marshalEntry(name, cvs)
+		if err != nil {
+			return written, err
+		}
+		if err := write(b); err != nil {
+			return written, err
+		}
+	}
+	return written, write(header[at+len(placeholder):])
+}
+
+// marshalEntry marshals the versions of one chart the way they appear under
+// entries in a marshaled index.
+func marshalEntry(name string, cvs ChartVersions) ([]byte, error) {
+	b, err := yaml.Marshal(map[string]ChartVersions{name: cvs})
+	if err != nil {
+		return nil, err
+	}
+	// Nest the chart under entries by indenting each of its lines. Empty
+	// lines, such as those in block scalars, are not indented.
+	var indented bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 && line[0] != '\n' {
+			indented.WriteString("  ")
+		}
+		indented.Write(line)
+	}
+	return indented.Bytes(), nil
+}
+
+// Merge merges the given index file into this index.
+//
+// This merges by name and version.
+//
+// If one of the entries in the given index does _not_ already exist, it is added.
+// In all other cases, the existing record is preserved.
+//
+// This can leave the index in an unsorted state
+func (i *IndexFile) Merge(f *IndexFile) {
+	i.MergeWithOptions(f, MergeOptions{})
+}
+
+// MergeStrategy decides which entry is kept when both indices being merged
+// contain the same chart version.
+type MergeStrategy int
+
+const (
+	// MergeKeepExisting keeps the entry already in the receiving index.
+	MergeKeepExisting MergeStrategy = iota
+	// MergeOverwrite replaces the existing entry with the one being merged in.
+	MergeOverwrite
+)
+
+// MergeOptions configures how MergeWithOptions merges two index files.
+type MergeOptions struct {
+	// Strategy decides which entry is kept when a chart version is present in
+	// both indices. It defaults to MergeKeepExisting.
+	Strategy MergeStrategy
+
+	// UpdateGenerated sets the Generated time of the merged index to the
+	// newer of the two indices' Generated times. By default, the Generated
+	// time of the receiving index is kept as is.
+	UpdateGenerated bool
+
+	// MaxEntriesPerChart caps the number of new versions added for any one
+	// chart. Zero means no limit.
+	MaxEntriesPerChart int
+
+	// MaxTotalEntries caps the number of new versions added overall. Zero
+	// means no limit.
+	MaxTotalEntries int
+
+	// PreferSigned keeps, when a chart version is present in both indices,
+	// whichever entry has a digest over one that does not, regardless of
+	// Strategy. If both entries or neither have a digest, Strategy decides.
+	PreferSigned bool
+
+	// RecordSuperseded lists the entries that were replaced during the merge
+	// in MergeResult.Superseded, so that a record of them is kept.
+	RecordSuperseded bool
+}
+
+// MergeResult describes the outcome of MergeWithOptions.
+type MergeResult struct {
+	// Capped lists, in name order, the charts for which versions were left
+	// out because a limit in MergeOptions was reached.
+	Capped []string
+
+	// Superseded lists the entries that were replaced by the merge, in chart
+	// name order. It is only populated if MergeOptions.RecordSuperseded is set.
+	Superseded []*ChartVersion
+}
+
+// MergeWithOptions merges the given index file into this index, like Merge,
+// using the given options.
+//
+// The limits in the options are a best-effort safety valve against indices
+// with an unreasonable number of entries. They are applied while walking the
+// given index in chart name order, and in the order versions are listed for
+// each chart, so which versions are left out depends on that order.
+//
+// This can leave the index in an unsorted state
+func (i *IndexFile) MergeWithOptions(f *IndexFile, opts MergeOptions) MergeResult {
+	var result MergeResult
+	names := make([]string, 0, len(f.Entries))
+	for name := range f.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	added := map[string]int{}
+	total := 0
+	capped := map[string]bool{}
+	for _, name := range names {
+		for _, cv := range f.Entries[name] {
+			existing, err := i.Get(cv.Name, cv.Version)
+			if err != nil {
+				if (opts.MaxTotalEntries > 0 && total >= opts.MaxTotalEntries) ||
+					(opts.MaxEntriesPerChart > 0 && added[cv.Name] >= opts.MaxEntriesPerChart) {
+					if !capped[cv.Name] {
+						capped[cv.Name] = true
+						result.Capped = append(result.Capped, cv.Name)
+					}
+					continue
+				}
+				e := i.Entries[cv.Name]
+				i.Entries[cv.Name] = append(e, cv)
+				added[cv.Name]++
+				total++
+				continue
+			}
+			replace := opts.Strategy == MergeOverwrite
+			if opts.PreferSigned && (existing.Digest == "") != (cv.Digest == "") {
+				replace = cv.Digest != ""
+			}
+			if replace {
+				for idx, e := range i.Entries[cv.Name] {
+					if e == existing {
+						i.Entries[cv.Name][idx] = cv
+						break
+					}
+				}
+				if opts.RecordSuperseded {
+					result.Superseded = append(result.Superseded, existing)
+				}
+			}
+		}
+	}
+	if opts.UpdateGenerated && f.Generated.After(i.Generated) {
+		i.Generated = f.Generated
+	}
+	sort.Strings(result.Capped)
+	return result
+}
+
+// MergeCharts merges only the named charts from the given index file into this
+// index, deciding conflicts with the given strategy. Names that are not in f
+// are ignored.
+//
+// This can leave the index in an unsorted state
+func (i *IndexFile) MergeCharts(f *IndexFile, names []string, strategy MergeStrategy) MergeResult {
+	selected := &IndexFile{Entries: map[string]ChartVersions{}}
+	for _, name := range names {
+		if cvs, ok := f.Entries[name]; ok {
+			selected.Entries[name] = cvs
+		}
+	}
+	return i.MergeWithOptions(selected, MergeOptions{Strategy: strategy})
+}
+
+// RenameOptions configures RenameChartWithOptions.
+type RenameOptions struct {
+	// Merge merges the renamed versions into the chart already indexed under
+	// the new name, instead of failing.
+	Merge bool
+
+	// Strategy decides, when merging, which entry is kept for a version
+	// present under both names. It defaults to MergeKeepExisting, which keeps
+	// the entry already under the new name.
+	Strategy MergeStrategy
+}
+
+// RenameChart moves the versions of the chart named oldName to newName and
+// updates the name in their metadata. It fails if a chart named newName is
+// already in the index.
+//
+// This can leave the index in an unsorted state
+func (i *IndexFile) RenameChart(oldName, newName string) error {
+	return i.RenameChartWithOptions(oldName, newName, RenameOptions{})
+}
+
+// RenameChartWithOptions is like RenameChart, but lets the caller merge into an
+// existing chart.
+//
+// This can leave the index in an unsorted state
+func (i *IndexFile) RenameChartWithOptions(oldName, newName string, opts RenameOptions) error {
+	cvs, ok := i.Entries[oldName]
+	if !ok {
+		return ErrNoChartName
+	}
+	if newName == "" || newName != filepath.Base(newName) {
+		return errors.Errorf("invalid chart name %q", newName)
+	}
+	if newName == oldName {
+		return nil
+	}
+	_, exists := i.Entries[newName]
+	if exists && !opts.Merge {
+		return errors.Errorf("chart %q already exists in the index", newName)
+	}
+
+	for _, cv := range cvs {
+		if cv != nil && cv.Metadata != nil {
+			cv.Name = newName
+		}
+	}
+	delete(i.Entries, oldName)
+	if !exists {
+		i.Entries[newName] = cvs
+		return nil
+	}
+	i.MergeWithOptions(&IndexFile{Entries: map[string]ChartVersions{newName: cvs}}, MergeOptions{Strategy: opts.Strategy})
+	return nil
+}
+
+// MapURLs replaces every URL in the index with the result of calling f with the
+// chart name, version, and current URL.
+//
+// If f returns an empty string, the URL is removed from the entry.
+func (i IndexFile) MapURLs(f func(chartName, version, url string) string) {
+	for name, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			urls := make([]string, 0, len(cv.URLs))
+			for _, u := range cv.URLs {
+				if nu := f(name, cv.Version, u); nu != "" {
+					urls = append(urls, nu)
+				}
+			}
+			cv.URLs = urls
+		}
+	}
+}
+
+// APIVersionBreakdown returns the number of chart entries for each chart API
+// version declared in the index.
+func (i IndexFile) APIVersionBreakdown() map[string]int {
+	breakdown := map[string]int{}
+	for _, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			breakdown[cv.APIVersion]++
+		}
+	}
+	return breakdown
+}
+
+// AnnotateLatestStable records the latest stable version of each chart in the
+// AnnotationLatestStable annotation of every one of that chart's entries.
+//
+// Prerelease versions and versions that cannot be parsed are not considered.
+// Charts without a stable version are left untouched. Calling this again after
+// the entries changed updates the annotation.
+func (i IndexFile) AnnotateLatestStable() {
+	for _, cvs := range i.Entries {
+		var latest *semver.Version
+		var latestVersion string
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			v, err := semver.NewVersion(cv.Version)
+			if err != nil || v.Prerelease() != "" {
+				continue
+			}
+			if latest == nil || v.GreaterThan(latest) {
+				latest = v
+				latestVersion = cv.Version
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			if cv.Annotations == nil {
+				cv.Annotations = map[string]string{}
+			}
+			cv.Annotations[AnnotationLatestStable] = latestVersion
+		}
+	}
+}
+
+// PrereleaseOptions configures PrereleaseOnlyChartsWithOptions.
+type PrereleaseOptions struct {
+	// IncludeUnparseable also reports charts none of whose versions can be
+	// parsed as semantic versions, since they have no stable release either.
+	IncludeUnparseable bool
+}
+
+// PrereleaseOnlyCharts returns, in name order, the charts that have never
+// shipped a stable release: every version of them that can be parsed has a
+// prerelease segment. Charts without any parseable version are left out.
+func (i IndexFile) PrereleaseOnlyCharts() []string {
+	return i.PrereleaseOnlyChartsWithOptions(PrereleaseOptions{})
+}
+
+// PrereleaseOnlyChartsWithOptions is like PrereleaseOnlyCharts, using the given
+// options.
+func (i IndexFile) PrereleaseOnlyChartsWithOptions(opts PrereleaseOptions) []string {
+	var names []string
+	for name, cvs := range i.Entries {
+		if len(cvs) == 0 {
+			continue
+		}
+		parsed, stable := 0, false
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			v, err := semver.NewVersion(cv.Version)
+			if err != nil {
+				continue
+			}
+			parsed++
+			if v.Prerelease() == "" {
+				stable = true
+				break
+			}
+		}
+		if stable || (parsed == 0 && !opts.IncludeUnparseable) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeprecatedLatest returns, in name order, the charts whose newest version is
+// marked deprecated, whether or not older versions are. Such charts are
+// effectively end of life. Versions that cannot be parsed are not considered.
+func (i IndexFile) DeprecatedLatest() []string {
+	var names []string
+	for name, cvs := range i.Entries {
+		newest, version := newestVersion(cvs)
+		if newest == nil {
+			continue
+		}
+		for _, cv := range cvs {
+			if cv != nil && cv.Metadata != nil && cv.Version == version {
+				if cv.Deprecated {
+					names = append(names, name)
+				}
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FilterByMaintainer returns a new index containing only the chart versions
+// maintained by someone whose name or email matches nameOrEmail, ignoring case.
+//
+// Charts without any matching version are left out of the returned index.
+func (i IndexFile) FilterByMaintainer(nameOrEmail string) *IndexFile {
+	return i.filter(func(cv *ChartVersion) bool {
+		for _, m := range cv.Maintainers {
+			if m == nil {
+				continue
+			}
+			if strings.EqualFold(m.Name, nameOrEmail) || strings.EqualFold(m.Email, nameOrEmail) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Subset returns a new index containing only the charts with the given names,
+// with all of their versions.
+//
+// Names that are not in the index are ignored. The source index is not
+// modified.
+func (i IndexFile) Subset(names ...string) *IndexFile {
+	out := i.emptyCopy()
+	for _, name := range names {
+		if cvs, ok := i.Entries[name]; ok {
+			out.Entries[name] = append(ChartVersions{}, cvs...)
+		}
+	}
+	return out
+}
+
+// InconsistentEntry describes a chart version that is listed more than once in
+// an index with disagreeing digests.
+type InconsistentEntry struct {
+	Name    string
+	Version string
+	// Digests holds the distinct digests found for the version.
+	Digests []string
+	// URLs holds the URLs of all the entries for the version.
+	URLs []string
+}
+
+// ConsistencyCheck reports chart versions that appear more than once in the
+// index with different digests.
+//
+// Duplicate entries that agree on their digest, such as the same chart served
+// from several mirrors, are not reported. The report is sorted by chart name
+// and version.
+func (i IndexFile) ConsistencyCheck() []InconsistentEntry {
+	var report []InconsistentEntry
+	for name, cvs := range i.Entries {
+		var versions []string
+		groups := map[string]ChartVersions{}
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			if _, ok := groups[cv.Version]; !ok {
+				versions = append(versions, cv.Version)
+			}
+			groups[cv.Version] = append(groups[cv.Version], cv)
+		}
+
+		for _, version := range versions {
+			entry := InconsistentEntry{Name: name, Version: version}
+			seen := map[string]bool{}
+			for _, cv := range groups[version] {
+				if d := normalizeDigest(cv.Digest); !seen[d] {
+					seen[d] = true
+					entry.Digests = append(entry.Digests, cv.Digest)
+				}
+				entry.URLs = append(entry.URLs, cv.URLs...)
+			}
+			if len(entry.Digests) > 1 {
+				report = append(report, entry)
+			}
+		}
+	}
+	sort.Slice(report, func(a, b int) bool {
+		if report[a].Name != report[b].Name {
+			return report[a].Name < report[b].Name
+		}
+		return report[a].Version < report[b].Version
+	})
+	return report
+}
+
+// DigestFormatIssue describes a chart version whose digest is not in the
+// format Helm produces.
+type DigestFormatIssue struct {
+	Name    string
+	Version string
+	Digest  string
+	// Problem explains what is wrong with the digest.
+	Problem string
+}
+
+// ValidateDigestFormats reports the chart versions whose digest is empty, uses
+// an algorithm prefix other than "sha256:", or is not a hex-encoded SHA-256
+// sum. Digests with and without the "sha256:" prefix are both accepted.
+//
+// The report is sorted by chart name and version.
+func (i IndexFile) ValidateDigestFormats() []DigestFormatIssue {
+	var report []DigestFormatIssue
+	for name, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			if problem := digestFormatProblem(cv.Digest); problem != "" {
+				report = append(report, DigestFormatIssue{Name: name, Version: cv.Version, Digest: cv.Digest, Problem: problem})
+			}
+		}
+	}
+	sort.Slice(report, func(a, b int) bool {
+		if report[a].Name != report[b].Name {
+			return report[a].Name < report[b].Name
+		}
+		return report[a].Version < report[b].Version
+	})
+	return report
+}
+
+// digestFormatProblem returns what is wrong with the format of digest, or the
+// empty string if nothing is.
+func digestFormatProblem(digest string) string {
+	if digest == "" {
+		return "digest is empty"
+	}
+	sum := digest
+	if algorithm, rest, ok := strings.Cut(digest, ":"); ok {
+		if algorithm != "sha256" {
+			return fmt.Sprintf("unexpected digest algorithm %q", algorithm)
+		}
+		sum = rest
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "digest is not a hex-encoded SHA-256 sum"
+	}
+	return ""
+}
+
+// RecomputeDigests recomputes the digest of every entry in the index from its
+// local archive and returns the number of digests that changed.
+//
+// The resolve function returns the path of the archive for an entry. Entries
+// whose archive cannot be resolved or read keep their current digest, and the
+// errors for them are collected into the returned error.
+func (i IndexFile) RecomputeDigests(resolve func(cv *ChartVersion) (string, error)) (int, error) {
+	var result error
+	changed := 0
+	for _, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			path, err := resolve(cv)
+			if err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "could not resolve archive for %s %s", cv.Name, cv.Version))
+				continue
+			}
+			digest, err := provenance.DigestFile(path)
+			if err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "could not digest archive for %s %s", cv.Name, cv.Version))
+				continue
+			}
+			if normalizeDigest(cv.Digest) != normalizeDigest(digest) {
+				cv.Digest = digest
+				changed++
+			}
+		}
+	}
+	return changed, result
+}
+
+// SetReplacement records replacement as the chart replacing the named chart
+// on every version of it. An empty replacement removes the annotation.
+func (i IndexFile) SetReplacement(name, replacement string) error {
+	cvs, ok := i.Entries[name]
+	if !ok {
+		return ErrNoChartName
+	}
+	for _, cv := range cvs {
+		if cv == nil || cv.Metadata == nil {
+			continue
+		}
+		if replacement == "" {
+			delete(cv.Annotations, AnnotationReplacedBy)
+			continue
+		}
+		if cv.Annotations == nil {
+			cv.Annotations = map[string]string{}
+		}
+		cv.Annotations[AnnotationReplacedBy] = replacement
+	}
+	return nil
+}
+
+// FilterByKubeVersion returns a new index containing only the chart versions
+// whose KubeVersion constraint is satisfied by the given Kubernetes version.
+//
+// Chart versions without a KubeVersion constraint are kept, while those with a
+// constraint that cannot be parsed are dropped. Charts without any remaining
+// version are left out of the returned index.
+func (i IndexFile) FilterByKubeVersion(kubeVersion string) (*IndexFile, error) {
+	if _, err := semver.NewVersion(kubeVersion); err != nil {
+		return nil, errors.Wrapf(err, "invalid Kubernetes version %q", kubeVersion)
+	}
+	return i.filter(func(cv *ChartVersion) bool {
+		return cv.KubeVersion == "" || chartutil.IsCompatibleRange(cv.KubeVersion, kubeVersion)
+	}), nil
+}
+
+// ExpireOlderThan removes the chart versions created more than d ago, as told
+// by the clock of the index, and returns the number of versions removed.
+//
+// Versions without a Created time are kept. Charts left without any version
+// are removed from the index, and the remaining entries are sorted.
+func (i IndexFile) ExpireOlderThan(d time.Duration) int {
+	cutoff := i.currentTime().Add(-d)
+	removed := 0
+	for name, cvs := range i.Entries {
+		kept := cvs[:0]
+		for _, cv := range cvs {
+			if cv != nil && !cv.Created.IsZero() && cv.Created.Before(cutoff) {
+				removed++
+				continue
+			}
+			kept = append(kept, cv)
+		}
+		if len(kept) == 0 {
+			delete(i.Entries, name)
+			continue
+		}
+		i.Entries[name] = kept
+	}
+	i.SortEntries()
+	return removed
+}
+
+// PruneByMajor removes, for each chart, the versions whose major version is
+// not one of the keepMajors highest major versions of that chart, and returns
+// the number of versions removed. A keepMajors of zero or less keeps every
+// version.
+//
+// Versions that cannot be parsed as semantic versions are always kept. The
+// remaining entries are sorted.
+func (i IndexFile) PruneByMajor(keepMajors int) int {
+	if keepMajors <= 0 {
+		return 0
+	}
+	removed := 0
+	for name, cvs := range i.Entries {
+		majors := map[uint64]bool{}
+		for _, cv := range cvs {
+			if cv == nil {
+				continue
+			}
+			if v, err := semver.NewVersion(cv.Version); err == nil {
+				majors[v.Major()] = true
+			}
+		}
+		if len(majors) <= keepMajors {
+			continue
+		}
+		sorted := make([]uint64, 0, len(majors))
+		for major := range majors {
+			sorted = append(sorted, major)
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] > sorted[b] })
+		oldest := sorted[keepMajors-1]
+
+		kept := cvs[:0]
+		for _, cv := range cvs {
+			if cv != nil {
+				if v, err := semver.NewVersion(cv.Version); err == nil && v.Major() < oldest {
+					removed++
+					continue
+				}
+			}
+			kept = append(kept, cv)
+		}
+		i.Entries[name] = kept
+	}
+	i.SortEntries()
+	return removed
+}
+
+// PrunePerChart removes all but the newest versions of each chart and returns
+// the number of versions removed.
+//
+// The number of versions kept for a chart is looked up by name in policy,
+// falling back to defaultKeep for charts not listed. A count of zero or less
+// keeps every version of the chart. Versions that cannot be parsed as semantic
+// versions are always kept and do not count towards the limit. The remaining
+// entries are sorted.
+func (i IndexFile) PrunePerChart(policy map[string]int, defaultKeep int) int {
+	removed := 0
+	for name, cvs := range i.Entries {
+		keep, ok := policy[name]
+		if !ok {
+			keep = defaultKeep
+		}
+		if keep <= 0 {
+			continue
+		}
+
+		type parsed struct {
+			cv *ChartVersion
+			v  *semver.Version
+		}
+		var versions []parsed
+		for _, cv := range cvs {
+			if cv == nil {
+				continue
+			}
+			if v, err := semver.NewVersion(cv.Version); err == nil {
+				versions = append(versions, parsed{cv, v})
+			}
+		}
+		if len(versions) <= keep {
+			continue
+		}
+		sort.SliceStable(versions, func(a, b int) bool {
+			return versions[a].v.GreaterThan(versions[b].v)
+		})
+		drop := map[*ChartVersion]bool{}
+		for _, p := range versions[keep:] {
+			drop[p.cv] = true
+		}
+
+		kept := cvs[:0]
+		for _, cv := range cvs {
+			if drop[cv] {
+				removed++
+				continue
+			}
+			kept = append(kept, cv)
+		}
+		i.Entries[name] = kept
+	}
+	i.SortEntries()
+	return removed
+}
+
+// SetRecommended records version as the recommended version of the named
+// chart in the index annotations.
+//
+// The version must be one of the versions of the chart in the index.
+func (i *IndexFile) SetRecommended(name, version string) error {
+	cvs, ok := i.Entries[name]
+	if !ok {
+		return ErrNoChartName
+	}
+	for _, cv := range cvs {
+		if cv != nil && cv.Metadata != nil && cv.Version == version {
+			if i.Annotations == nil {
+				i.Annotations = map[string]string{}
+			}
+			i.Annotations[recommendedAnnotationPrefix+name] = version
+			return nil
+		}
+	}
+	return errors.Errorf("no chart version found for %s-%s", name, version)
+}
+
+// Recommended returns the recommended version of the named chart, if one was
+// recorded with SetRecommended.
+func (i IndexFile) Recommended(name string) (string, bool) {
+	version, ok := i.Annotations[recommendedAnnotationPrefix+name]
+	return version, ok
+}
+
+// ChartRef identifies a chart version in an index.
+type ChartRef struct {
+	Name    string
+	Version string
+}
+
+// MissingArchives reports the chart versions whose archive is not present in
+// dir.
+//
+// The archive of an entry is looked up in dir by the trailing path elements of
+// each of its URLs, from the file name alone up to the full URL path, so
+// archives kept in subdirectories of dir are found as well. An entry is
+// reported when none of those files exist. Entries without URLs are not
+// reported. The report is sorted by chart name and version.
+func (i IndexFile) MissingArchives(dir string) []ChartRef {
+	var missing []ChartRef
+	for name, cvs := range i.Entries {
+	Versions:
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil || len(cv.URLs) == 0 {
+				continue
+			}
+			for _, u := range cv.URLs {
+				p := u
+				if parsed, err := url.Parse(u); err == nil {
+					p = parsed.Path
+				}
+				segments := strings.Split(strings.Trim(p, "/"), "/")
+				for s := len(segments) - 1; s >= 0; s-- {
+					rel := filepath.FromSlash(path.Join(segments[s:]...))
+					if rel == "." {
+						continue
+					}
+					if fi, err := os.Stat(filepath.Join(dir, rel)); err == nil && !fi.IsDir() {
+						continue Versions
+					}
+				}
+			}
+			missing = append(missing, ChartRef{Name: name, Version: cv.Version})
+		}
+	}
+	sortChartRefs(missing)
+	return missing
+}
+
+// YankedRef records a chart version whose dependency resolves to a version
+// marked as removed.
+type YankedRef struct {
+	// Chart is the dependent chart version.
+	Chart ChartRef
+	// Dependency is the removed version the dependency resolves to.
+	Dependency ChartRef
+}
+
+// YankedDependencies reports the chart versions with a dependency that, resolved
+// against this index the way Get resolves versions, selects a version marked as
+// removed.
+//
+// Dependencies are matched to entries by chart name only, regardless of the
+// repository they declare. Dependencies on charts not in the index, and
+// dependencies of removed versions, are not reported. The report is sorted by
+// dependent and then by dependency.
+func (i IndexFile) YankedDependencies() []YankedRef {
+	var yanked []YankedRef
+	for name, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil || cv.Removed {
+				continue
+			}
+			for _, dep := range cv.Dependencies {
+				if dep == nil {
+					continue
+				}
+				resolved, err := i.Get(dep.Name, dep.Version)
+				if err != nil || !resolved.Removed {
+					continue
+				}
+				yanked = append(yanked, YankedRef{
+					Chart:      ChartRef{Name: name, Version: cv.Version},
+					Dependency: ChartRef{Name: dep.Name, Version: resolved.Version},
+				})
+			}
+		}
+	}
+	sort.Slice(yanked, func(a, b int) bool {
+		if yanked[a].Chart != yanked[b].Chart {
+			return chartRefLess(yanked[a].Chart, yanked[b].Chart)
+		}
+		return chartRefLess(yanked[a].Dependency, yanked[b].Dependency)
+	})
+	return yanked
+}
+
+// UnresolvedDep describes a chart dependency that no version in the index
+// satisfies.
+type UnresolvedDep struct {
+	// Chart is the chart version declaring the dependency.
+	Chart      ChartRef
+	Dependency string
+	Constraint string
+	Repository string
+}
+
+// DependencyValidationOptions configures ValidateDependenciesWithOptions.
+type DependencyValidationOptions struct {
+	// SkipRepository, if set, is called with the repository of every
+	// dependency. Dependencies for which it returns true, such as those on
+	// repositories known to be external, are not checked.
+	SkipRepository func(repository string) bool
+}
+
+// ValidateDependencies reports the dependencies of the charts in the index
+// that no chart version in the same index satisfies.
+//
+// Dependencies are matched by name and resolved against their version
+// constraint the way Get resolves versions, whatever repository they declare.
+// Dependencies without a repository or with a file:// repository are part of
+// the chart archive itself and are not checked. The report is sorted by
+// dependent chart and then by dependency name.
+func (i IndexFile) ValidateDependencies() []UnresolvedDep {
+	return i.ValidateDependenciesWithOptions(DependencyValidationOptions{})
+}
+
+// ValidateDependenciesWithOptions is like ValidateDependencies, but lets the
+// caller configure which dependencies are checked.
+func (i IndexFile) ValidateDependenciesWithOptions(opts DependencyValidationOptions) []UnresolvedDep {
+	var report []UnresolvedDep
+	for name, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			for _, dep := range cv.Dependencies {
+				if dep == nil || dep.Repository == "" || strings.HasPrefix(dep.Repository, "file://") {
+					continue
+				}
+				if opts.SkipRepository != nil && opts.SkipRepository(dep.Repository) {
+					continue
+				}
+				if _, err := i.Get(dep.Name, dep.Version); err == nil {
+					continue
+				}
+				report = append(report, UnresolvedDep{
+					Chart:      ChartRef{Name: name, Version: cv.Version},
+					Dependency: dep.Name,
+					Constraint: dep.Version,
+					Repository: dep.Repository,
+				})
+			}
+		}
+	}
+	sort.Slice(report, func(a, b int) bool {
+		if report[a].Chart != report[b].Chart {
+			return chartRefLess(report[a].Chart, report[b].Chart)
+		}
+		return report[a].Dependency < report[b].Dependency
+	})
+	return report
+}
+
+// DependencyClosure returns a new index containing the given version of the
+// named chart and, transitively, the version of each of its dependencies that
+// the index resolves them to, as Get would. This is the smallest index from
+// which the chart can be installed.
+//
+// Dependencies without a repository or with a file:// repository are bundled
+// with the chart and need no entry. If any other dependency cannot be resolved
+// within the index, an error listing all of them is returned. The entries of
+// the returned index are shared with this index.
+func (i IndexFile) DependencyClosure(name, version string) (*IndexFile, error) {
+	root, err := i.Get(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[*ChartVersion]bool{root: true}
+	queue := []*ChartVersion{root}
+	var missing []string
+	for len(queue) > 0 {
+		cv := queue[0]
+		queue = queue[1:]
+		for _, dep := range cv.Dependencies {
+			if dep == nil || dep.Repository == "" || strings.HasPrefix(dep.Repository, "file://") {
+				continue
+			}
+			resolved, err := i.Get(dep.Name, dep.Version)
+			if err != nil {
+				missing = append(missing, fmt.Sprintf("%s %q (required by %s-%s)", dep.Name, dep.Version, cv.Name, cv.Version))
+				continue
+			}
+			if !keep[resolved] {
+				keep[resolved] = true
+				queue = append(queue, resolved)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.Errorf("missing dependencies: %s", strings.Join(missing, ", "))
+	}
+
+	closure := i.filter(func(cv *ChartVersion) bool { return keep[cv] })
+	closure.SortEntries()
+	return closure, nil
+}
+
+// RegressedCharts reports the charts whose newest version in this index is
+// lower than their newest version in baseline, such as after a merge let an
+// outdated mirror win. The Version of each reference is the newest version in
+// this index.
+//
+// Versions that cannot be parsed are ignored, and charts missing from either
+// index are not reported. The report is sorted by chart name.
+func (i IndexFile) RegressedCharts(baseline *IndexFile) []ChartRef {
+	var regressed []ChartRef
+	for name, cvs := range i.Entries {
+		current, currentVersion := newestVersion(cvs)
+		if current == nil {
+			continue
+		}
+		previous, _ := newestVersion(baseline.Entries[name])
+		if previous != nil && current.LessThan(previous) {
+			regressed = append(regressed, ChartRef{Name: name, Version: currentVersion})
+		}
+	}
+	sortChartRefs(regressed)
+	return regressed
+}
+
+// RecentlyUpdated returns up to limit charts, most recently updated first,
+// ranked by the Created time of their newest version. A limit of zero or less
+// returns every chart. The Version of each reference is that newest version.
+//
+// Charts whose newest version has no Created time come last, and ties are
+// broken by chart name so the order is stable. Charts without a parseable
+// version are left out.
+func (i IndexFile) RecentlyUpdated(limit int) []ChartRef {
+	type updated struct {
+		ref     ChartRef
+		created time.Time
+	}
+	var charts []updated
+	for name, cvs := range i.Entries {
+		newest, version := newestVersion(cvs)
+		if newest == nil {
+			continue
+		}
+		for _, cv := range cvs {
+			if cv != nil && cv.Metadata != nil && cv.Version == version {
+				charts = append(charts, updated{ChartRef{Name: name, Version: version}, cv.Created})
+				break
+			}
+		}
+	}
+	sort.Slice(charts, func(a, b int) bool {
+		if !charts[a].created.Equal(charts[b].created) {
+			return charts[a].created.After(charts[b].created)
+		}
+		return charts[a].ref.Name < charts[b].ref.Name
+	})
+
+	if limit > 0 && len(charts) > limit {
+		charts = charts[:limit]
+	}
+	refs := make([]ChartRef, len(charts))
+	for idx, c := range charts {
+		refs[idx] = c.ref
+	}
+	return refs
+}
+
+// newestVersion returns the highest parseable version among cvs, along with
+// the version string of its entry. It returns nil if there is none.
+func newestVersion(cvs ChartVersions) (*semver.Version, string) {
+	var newest *semver.Version
+	var version string
+	for _, cv := range cvs {
+		if cv == nil || cv.Metadata == nil {
+			continue
+		}
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil {
+			continue
+		}
+		if newest == nil || v.GreaterThan(newest) {
+			newest, version = v, cv.Version
+		}
+	}
+	return newest, version
+}
+
+// sortChartRefs sorts chart references by name and version.
+func sortChartRefs(refs []ChartRef) {
+	sort.Slice(refs, func(a, b int) bool {
+		return chartRefLess(refs[a], refs[b])
+	})
+}
+
+// chartRefLess orders chart references by name and version.
+func chartRefLess(a, b ChartRef) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Version < b.Version
+}
+
+// FilterByPlatform returns a new index containing only the chart versions that
+// target the given operating system and architecture, as declared by their
+// AnnotationOS and AnnotationArch annotations.
+//
+// A version without one of these annotations is treated as supporting every
+// value for it. Values are compared case-insensitively. Charts without any
+// remaining version are left out of the returned index.
+func (i IndexFile) FilterByPlatform(osName, arch string) *IndexFile {
+	return i.filter(func(cv *ChartVersion) bool {
+		return annotationAllows(cv.Annotations, AnnotationOS, osName) &&
+			annotationAllows(cv.Annotations, AnnotationArch, arch)
+	})
+}
+
+// annotationAllows reports whether the comma-separated list in the given
+// annotation contains value. A missing or empty annotation allows any value.
+func annotationAllows(annotations map[string]string, key, value string) bool {
+	list := strings.TrimSpace(annotations[key])
+	if list == "" {
+		return true
+	}
+	for _, v := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateNames returns, sorted, the names of the charts in the index that do
+// not match the given regular expression. An error is returned if the pattern
+// cannot be compiled.
+//
+// The pattern is not anchored implicitly; use ^ and $ to match whole names.
+func (i IndexFile) ValidateNames(pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid chart name pattern %q", pattern)
+	}
+	var invalid []string
+	for name := range i.Entries {
+		if !re.MatchString(name) {
+			invalid = append(invalid, name)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid, nil
+}
+
+// CanonicalizeURLs rewrites every chart URL in the index into a canonical form
+// and returns the number of URLs that changed.
+//
+// Paths are cleaned the way urlutil.Equal cleans them before comparing, which
+// collapses repeated slashes and dot segments. In addition, the scheme and
+// host are lowercased and the default port of http and https URLs is dropped.
+// URLs that cannot be parsed are left as they are.
+func (i IndexFile) CanonicalizeURLs() int {
+	changed := 0
+	for _, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			for idx, u := range cv.URLs {
+				if c := canonicalURL(u); c != u {
+					cv.URLs[idx] = c
+					changed++
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// canonicalURL returns the canonical form of u used by CanonicalizeURLs.
+func canonicalURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	host := strings.ToLower(parsed.Host)
+	if (parsed.Scheme == "http" && strings.HasSuffix(host, ":80")) ||
+		(parsed.Scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	parsed.Host = host
+	if parsed.Path != "" {
+		parsed.Path = path.Clean(parsed.Path)
+		parsed.RawPath = ""
+	}
+	return parsed.String()
+}
+
+// OCIReference is the OCI registry reference a chart version maps to.
+type OCIReference struct {
+	Name    string
+	Version string
+	// Reference is the oci:// reference of the chart version.
+	Reference string
+	// Digest is the digest of the chart archive recorded in the index. This is
+	// not the digest of the OCI manifest the chart would be pushed as.
+	Digest string
+}
+
+// ToOCIReferences maps every chart version in the index to a reference in the
+// OCI registry at registryBase, of the form oci://registryBase/name:version.
+//
+// The registryBase may be given with or without the oci:// scheme. As in
+// registry tags, a "+" in a version is replaced with "_". References are
+// sorted by chart name, keeping the version order of the index.
+func (i IndexFile) ToOCIReferences(registryBase string) []OCIReference {
+	base := strings.TrimSuffix(strings.TrimPrefix(registryBase, registry.OCIScheme+"://"), "/")
+
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var refs []OCIReference
+	for _, name := range names {
+		for _, cv := range i.Entries[name] {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			refs = append(refs, OCIReference{
+				Name:      name,
+				Version:   cv.Version,
+				Reference: fmt.Sprintf("%s://%s/%s:%s", registry.OCIScheme, base, name, strings.ReplaceAll(cv.Version, "+", "_")),
+				Digest:    cv.Digest,
+			})
+		}
+	}
+	return refs
+}
+
+// TimestampAnomaly describes two versions of a chart whose Created times
+// disagree with their semantic version order.
+type TimestampAnomaly struct {
+	Name string
+	// Newer is the higher version, which was created before Older.
+	Newer        string
+	NewerCreated time.Time
+	// Older is the lower version, which was created after Newer.
+	Older        string
+	OlderCreated time.Time
+}
+
+// TimestampAnomalies reports, for each chart, the versions that were created
+// earlier than the version preceding them in semantic version order.
+//
+// Versions are compared with their neighbor in semver order, which uncovers
+// every chart whose Created times are not monotonic without reporting every
+// pair of versions around an outlier. Entries without a Created time and
+// versions that cannot be parsed are skipped. The report is sorted by chart
+// name, then in ascending version order.
+func (i IndexFile) TimestampAnomalies() []TimestampAnomaly {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var report []TimestampAnomaly
+	for _, name := range names {
+		type parsed struct {
+			cv *ChartVersion
+			v  *semver.Version
+		}
+		var versions []parsed
+		for _, cv := range i.Entries[name] {
+			if cv == nil || cv.Metadata == nil || cv.Created.IsZero() {
+				continue
+			}
+			if v, err := semver.NewVersion(cv.Version); err == nil {
+				versions = append(versions, parsed{cv, v})
+			}
+		}
+		sort.SliceStable(versions, func(a, b int) bool {
+			return versions[a].v.LessThan(versions[b].v)
+		})
+		for idx := 1; idx < len(versions); idx++ {
+			older, newer := versions[idx-1], versions[idx]
+			if newer.v.Equal(older.v) || !newer.cv.Created.Before(older.cv.Created) {
+				continue
+			}
+			report = append(report, TimestampAnomaly{
+				Name:         name,
+				Newer:        newer.cv.Version,
+				NewerCreated: newer.cv.Created,
+				Older:        older.cv.Version,
+				OlderCreated: older.cv.Created,
+			})
+		}
+	}
+	return report
+}
+
+// KeywordOptions configures how KeywordsWithOptions aggregates keywords.
+type KeywordOptions struct {
+	// LatestOnly counts only the keywords of the newest version of each
+	// chart, in the order SortEntries sorts versions, instead of those of
+	// every version.
+	LatestOnly bool
+
+	// Lowercase folds keywords to lowercase, so that keywords differing only
+	// in case are counted together.
+	Lowercase bool
+}
+
+// Keywords returns every keyword declared by the chart versions in the index,
+// along with the number of versions declaring it.
+func (i IndexFile) Keywords() map[string]int {
+	return i.KeywordsWithOptions(KeywordOptions{})
+}
+
+// KeywordsWithOptions is like Keywords, but lets the caller configure how the
+// keywords are aggregated.
+//
+// Surrounding whitespace is trimmed and empty keywords are ignored. A keyword
+// listed more than once by the same version is counted once.
+func (i IndexFile) KeywordsWithOptions(opts KeywordOptions) map[string]int {
+	keywords := map[string]int{}
+	for _, cvs := range i.Entries {
+		if opts.LatestOnly && len(cvs) > 0 {
+			sorted := append(ChartVersions{}, cvs...)
+			sort.Sort(sort.Reverse(sorted))
+			cvs = sorted[:1]
+		}
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			seen := map[string]bool{}
+			for _, k := range cv.Keywords {
+				k = strings.TrimSpace(k)
+				if opts.Lowercase {
+					k = strings.ToLower(k)
+				}
+				if k == "" || seen[k] {
+					continue
+				}
+				seen[k] = true
+				keywords[k]++
+			}
+		}
+	}
+	return keywords
+}
+
+// TotalSize returns the combined archive size, in bytes, of every chart
+// version in the index. Versions without a recorded Size count as zero.
+func (i IndexFile) TotalSize() int64 {
+	var total int64
+	for _, size := range i.ChartSizes() {
+		total += size
+	}
+	return total
+}
+
+// ChartSizes returns the combined archive size, in bytes, of the versions of
+// each chart in the index. Versions without a recorded Size count as zero.
+func (i IndexFile) ChartSizes() map[string]int64 {
+	sizes := make(map[string]int64, len(i.Entries))
+	for name, cvs := range i.Entries {
+		var size int64
+		for _, cv := range cvs {
+			if cv != nil {
+				size += cv.Size
+			}
+		}
+		sizes[name] = size
+	}
+	return sizes
+}
+
+// IncompleteOptions configures IncompleteWithOptions.
+type IncompleteOptions struct {
+	// AllVersions checks every version of each chart, reporting a field if
+	// any version misses it, instead of only the newest version.
+	AllVersions bool
+}
+
+// Incomplete reports, for each chart whose newest version leaves any of the
+// required metadata fields empty, the names of those fields.
+//
+// Field names are those of chart.Metadata, such as Description, Home, Icon or
+// Maintainers, and are matched case-insensitively. An error is returned for a
+// name that is not a field of chart.Metadata. Charts missing no field are not
+// included in the report.
+func (i IndexFile) Incomplete(required []string) (map[string][]string, error) {
+	return i.IncompleteWithOptions(required, IncompleteOptions{})
+}
+
+// IncompleteWithOptions is like Incomplete, but lets the caller configure which
+// versions are checked.
+func (i IndexFile) IncompleteWithOptions(required []string, opts IncompleteOptions) (map[string][]string, error) {
+	metadataType := reflect.TypeOf(chart.Metadata{})
+	fields := make([]reflect.StructField, 0, len(required))
+	for _, name := range required {
+		field, ok := metadataType.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+		if !ok {
+			return nil, errors.Errorf("unknown chart metadata field %q", name)
+		}
+		fields = append(fields, field)
+	}
+
+	report := map[string][]string{}
+	for name, cvs := range i.Entries {
+		if !opts.AllVersions && len(cvs) > 0 {
+			sorted := append(ChartVersions{}, cvs...)
+			sort.Sort(sort.Reverse(sorted))
+			cvs = sorted[:1]
+		}
+		var missing []string
+		for _, field := range fields {
+			for _, cv := range cvs {
+				if cv == nil || cv.Metadata == nil {
+					continue
+				}
+				if v := reflect.ValueOf(cv.Metadata).Elem().FieldByIndex(field.Index); isEmptyValue(v) {
+					missing = append(missing, field.Name)
+					break
+				}
+			}
+		}
+		if len(missing) > 0 {
+			report[name] = missing
+		}
+	}
+	return report, nil
+}
+
+// isEmptyValue reports whether v is a zero value or an empty slice or map.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// URLError describes a chart URL rejected by ValidateURLSchemes.
+type URLError struct {
+	Name    string
+	Version string
+	URL     string
+	// Reason explains why the URL was rejected.
+	Reason string
+}
+
+// ValidateURLSchemes reports the chart URLs in the index whose scheme is not
+// one of the allowed schemes, such as "https" or "oci". Schemes are compared
+// case-insensitively.
+//
+// Relative URLs have no scheme and are only accepted if the empty string is
+// one of the allowed schemes. URLs that cannot be parsed are always reported.
+// The report is sorted by chart name, version and URL.
+func (i IndexFile) ValidateURLSchemes(allowed []string) []URLError {
+	permitted := make(map[string]bool, len(allowed))
+	for _, scheme := range allowed {
+		permitted[strings.ToLower(scheme)] = true
+	}
+
+	var report []URLError
+	for name, cvs := range i.Entries {
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			for _, u := range cv.URLs {
+				var reason string
+				if parsed, err := url.Parse(u); err != nil {
+					reason = fmt.Sprintf("invalid URL: %s", err)
+				} else if scheme := strings.ToLower(parsed.Scheme); !permitted[scheme] {
+					reason = fmt.Sprintf("scheme %q is not allowed", scheme)
+					if scheme == "" {
+						reason = "relative URLs are not allowed"
+					}
+				}
+				if reason != "" {
+					report = append(report, URLError{Name: name, Version: cv.Version, URL: u, Reason: reason})
+				}
+			}
+		}
+	}
+	sort.Slice(report, func(a, b int) bool {
+		x, y := report[a], report[b]
+		if x.Name != y.Name {
+			return x.Name < y.Name
+		}
+		if x.Version != y.Version {
+			return x.Version < y.Version
+		}
+		return x.URL < y.URL
+	})
+	return report
+}
+
+// Delta returns a new index containing only the chart versions that are not
+// listed in known, which maps chart names to the versions a client already
+// has. Versions are compared as exact strings. The returned index has the same
+// top-level fields as this one and its entries are sorted.
+func (i IndexFile) Delta(known map[string][]string) *IndexFile {
+	seen := make(map[string]map[string]bool, len(known))
+	for name, versions := range known {
+		seen[name] = make(map[string]bool, len(versions))
+		for _, v := range versions {
+			seen[name][v] = true
+		}
+	}
+	// Entries are matched by the name they are listed under, which is what
+	// clients know them by, rather than by the name in their metadata.
+	out := i.emptyCopy()
+	for name, cvs := range i.Entries {
+		var kept ChartVersions
+		for _, cv := range cvs {
+			if cv != nil && cv.Metadata != nil && !seen[name][cv.Version] {
+				kept = append(kept, cv)
+			}
+		}
+		if len(kept) > 0 {
+			out.Entries[name] = kept
+		}
+	}
+	out.SortEntries()
+	return out
+}
+
+// filter returns a new index containing the chart versions for which keep
+// returns true. Charts without any remaining version are left out.
+func (i IndexFile) filter(keep func(cv *ChartVersion) bool) *IndexFile {
+	out := i.emptyCopy()
+	for name, cvs := range i.Entries {
+		var kept ChartVersions
+		for _, cv := range cvs {
+			if cv != nil && cv.Metadata != nil && keep(cv) {
+				kept = append(kept, cv)
+			}
+		}
+		if len(kept) > 0 {
+			out.Entries[name] = kept
+		}
+	}
+	return out
+}
+
+// Snapshot returns a deep copy of the index that shares no memory with it, so
+// that it can be handed to concurrent readers. The index itself is not safe
+// for concurrent use: code that refreshes a shared index should modify a
+// snapshot of it and then atomically swap the pointer readers use, rather than
+// mutating the index they are reading.
+func (i IndexFile) Snapshot() *IndexFile {
+	out := copystructure.Must(copystructure.Copy(i)).(IndexFile)
+	// copystructure skips unexported fields.
+	out.now = i.now
+	return &out
+}
+
+// shallowCopy returns a new index with the same top-level fields and entries.
+// The version lists are copied, but the chart versions in them are shared.
+func (i IndexFile) shallowCopy() *IndexFile {
+	out := i.emptyCopy()
+	for name, cvs := range i.Entries {
+		out.Entries[name] = append(ChartVersions{}, cvs...)
+	}
+	return out
+}
+
+// emptyCopy returns a new index with the same top-level fields but no entries.
+func (i IndexFile) emptyCopy() *IndexFile {
+	out := &IndexFile{
+		ServerInfo: i.ServerInfo,
+		APIVersion: i.APIVersion,
+		Generated:  i.Generated,
+		Entries:    map[string]ChartVersions{},
+
+		SemverOptions: i.SemverOptions,
+		now:           i.now,
+	}
+	if i.PublicKeys != nil {
+		out.PublicKeys = append([]string{}, i.PublicKeys...)
+	}
+	if i.Annotations != nil {
+		out.Annotations = make(map[string]string, len(i.Annotations))
+		for k, v := range i.Annotations {
+			out.Annotations[k] = v
+		}
+	}
+	return out
+}
+
+// MergeToFile merges the index files at the given paths, in order, and writes
+// the sorted result to dest with the given mode.
+//
+// The result is the same as loading every input and merging it into the first
+// one with Merge, so the first input listing a chart version wins. The merged
+// index is never held in memory as a whole: inputs are loaded one at a time
+// and the versions of each chart are spilled to a temporary directory, then
+// merged and written out one chart at a time. Memory use is bounded by the
+// largest input and the largest chart rather than by all inputs combined.
+func MergeToFile(dest string, mode os.FileMode, inputs []string) error {
+	if len(inputs) == 0 {
+		return errors.New("no index files to merge")
+	}
+	spillDir, err := os.MkdirTemp("", "helm-index-merge-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spillDir)
+
+	var top IndexFile
+	spills := map[string]string{}
+	for n, input := range inputs {
+		i, err := LoadIndexFile(input)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			top = *i
+			// Only the top-level fields of the first input are needed.
+			top.Entries = nil
+		}
+		for name, cvs := range i.Entries {
+			spill, ok := spills[name]
+			if !ok {
+				spill = filepath.Join(spillDir, strconv.Itoa(len(spills)))
+				spills[name] = spill
+			}
+			if err := appendSpill(spill, cvs); err != nil {
+				return errors.Wrapf(err, "error spilling %s from %s", name, input)
+			}
 		}
 	}
-	cr := &ChartVersion{
-		URLs:     []string{u},
-		Metadata: md,
-		Digest:   digest,
-		Created:  time.Now(),
+
+	names := make([]string, 0, len(spills))
+	for name := range spills {
+		names = append(names, name)
 	}
-	ee := i.Entries[md.Name]
-	i.Entries[md.Name] = append(ee, cr)
-	return nil
+	sort.Strings(names)
+
+	r, w := io.Pipe()
+	go func() {
+		_, err := top.writeEntries(w, names, func(name string) (ChartVersions, error) {
+			return mergeSpill(name, spills[name])
+		})
+		w.CloseWithError(err)
+	}()
+	err = fileutil.AtomicWriteFile(dest, r, mode)
+	r.CloseWithError(err)
+	return err
 }
 
-// Add adds a file to the index and logs an error.
-//
-// Deprecated: Use index.MustAdd instead.
-func (i IndexFile) Add(md *chart.Metadata, filename, baseURL, digest string) {
-	if err := i.MustAdd(md, filename, baseURL, digest); err != nil {
-		log.Printf("skipping loading invalid entry for chart %q %q from %s: %s", md.Name, md.Version, filename, err)
+// appendSpill appends the versions of a chart from one input to the spill file
+// at path, as a single JSON document.
+func appendSpill(path string, cvs ChartVersions) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(cvs); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
 
-// Has returns true if the index has an entry for a chart with the given name and exact version.
-func (i IndexFile) Has(name, version string) bool {
-	_, err := i.Get(name, version)
-	return err == nil
-}
+// mergeSpill merges the versions of the named chart in the spill file at path,
+// in the order they were appended, the same way Merge does, and sorts them.
+// The first document listing a version wins.
+func mergeSpill(name, path string) (ChartVersions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-// SortEntries sorts the entries by version in descending order.
-//
-// In canonical form, the individual version records should be sorted so that
-// the most recent release for every version is in the 0th slot in the
-// Entries.ChartVersions array. That way, tooling can predict the newest
-// version without needing to parse SemVers.
-func (i IndexFile) SortEntries() {
-	for _, versions := range i.Entries {
-		sort.Sort(sort.Reverse(versions))
+	var merged ChartVersions
+	seen := map[string]bool{}
+	dec := json.NewDecoder(f)
+	for first := true; ; first = false {
+		var cvs ChartVersions
+		if err := dec.Decode(&cvs); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "error reading spilled versions of %s", name)
+		}
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
+				continue
+			}
+			// Like Merge, versions of the first input are all kept, and
+			// later inputs only add versions not seen yet.
+			if !first && seen[cv.Version] {
+				continue
+			}
+			seen[cv.Version] = true
+			merged = append(merged, cv)
+		}
 	}
+	IndexFile{Entries: map[string]ChartVersions{name: merged}}.SortEntries()
+	return merged, nil
 }
 
-// Get returns the ChartVersion for the given name.
+// MergeAll merges the given indices into a new index, in order, using the
+// given strategy.
 //
-// If version is empty, this will return the chart with the latest stable version,
-// prerelease versions will be skipped.
-func (i IndexFile) Get(name, version string) (*ChartVersion, error) {
-	vs, ok := i.Entries[name]
-	if !ok {
-		return nil, ErrNoChartName
+// The result is the same as merging every index in turn into a copy of the
+// first one, but the merges are performed in parallel where possible. The
+// given indices are not modified, and the result shares no chart versions with
+// them. If ctx is canceled before the merge completes, its error is returned.
+//
+// The index returned will be in an unsorted state
+func MergeAll(ctx context.Context, indices []*IndexFile, strategy MergeStrategy) (*IndexFile, error) {
+	var level []*IndexFile
+	for _, idx := range indices {
+		if idx != nil {
+			level = append(level, idx)
+		}
 	}
-	if len(vs) == 0 {
-		return nil, ErrNoChartVersion
+	if len(level) == 0 {
+		return NewIndexFile(), ctx.Err()
 	}
 
-	var constraint *semver.Constraints
-	if version == "" {
-		constraint, _ = semver.NewConstraint("*")
-	} else {
-		var err error
-		constraint, err = semver.NewConstraint(version)
-		if err != nil {
-			return nil, err
-		}
+	// Merging moves chart versions from one index into another, so merge deep
+	// copies to leave the inputs alone.
+	var wg sync.WaitGroup
+	for n := range level {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			level[n] = level[n].Snapshot()
+		}(n)
 	}
+	wg.Wait()
 
-	// when customer input exact version, check whether have exact match one first
-	if len(version) != 0 {
-		for _, ver := range vs {
-			if version == ver.Version {
-				return ver, nil
+	opts := MergeOptions{Strategy: strategy}
+	for len(level) > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		next := make([]*IndexFile, (len(level)+1)/2)
+		for n := range next {
+			left := level[2*n]
+			next[n] = left
+			if 2*n+1 == len(level) {
+				continue
 			}
+			wg.Add(1)
+			go func(left, right *IndexFile) {
+				defer wg.Done()
+				if ctx.Err() == nil {
+					left.MergeWithOptions(right, opts)
+				}
+			}(left, level[2*n+1])
 		}
+		wg.Wait()
+		level = next
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return level[0], nil
+}
 
-	for _, ver := range vs {
-		test, err := semver.NewVersion(ver.Version)
-		if err != nil {
-			continue
-		}
+// ContentHash returns a hex-encoded SHA-256 hash of the content of the index.
+//
+// The hash does not depend on the order of charts and versions, nor on the
+// Generated and Created times, so two indices describing the same charts hash
+// the same even if they were generated at different times.
+//
+// The index is hashed in its JSON form. Loaded indices always marshal; only
+// values set by hand in ServerInfo or Extra that JSON cannot represent fail
+// to, and those are hashed by their marshaling error instead.
+func (i IndexFile) ContentHash() string {
+	c := i.emptyCopy()
+	c.Generated = time.Time{}
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		if constraint.Check(test) {
-			return ver, nil
+	hash := sha256.New()
+	hash.Write(hashableJSON(c))
+	for _, name := range names {
+		var versions []string
+		for _, cv := range i.Entries[name] {
+			if cv == nil {
+				continue
+			}
+			entry := *cv
+			entry.Created = time.Time{}
+			versions = append(versions, string(hashableJSON(entry)))
+		}
+		sort.Strings(versions)
+		fmt.Fprintf(hash, "\n%q", name)
+		for _, v := range versions {
+			fmt.Fprintf(hash, "\n%s", v)
 		}
 	}
-	return nil, errors.Errorf("no chart version found for %s-%s", name, version)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// WriteFile writes an index file to the given destination path.
-//
-// The mode on the file is set to 'mode'.
-func (i IndexFile) WriteFile(dest string, mode os.FileMode) error {
-	b, err := yaml.Marshal(i)
+// hashableJSON returns the JSON encoding of v for ContentHash, or the error
+// text if v cannot be marshaled.
+func hashableJSON(v interface{}) []byte {
+	b, err := json.Marshal(v)
 	if err != nil {
-		return err
+		return []byte(err.Error())
 	}
-	return fileutil.AtomicWriteFile(dest, bytes.NewReader(b), mode)
+	return b
 }
 
-// WriteJSONFile writes an index file in JSON format to the given destination
-// path.
+// IndexEqual reports whether two indices have the same content.
 //
-// The mode on the file is set to 'mode'.
-func (i IndexFile) WriteJSONFile(dest string, mode os.FileMode) error {
-	b, err := json.MarshalIndent(i, "", "  ")
+// The indices are compared in their canonical form, with the versions of
+// every chart sorted as SortEntries does, so the order in which entries were
+// added does not matter. Neither index is modified.
+func IndexEqual(a, b *IndexFile) (bool, error) {
+	if a == nil || b == nil {
+		return a == b, nil
+	}
+	x, err := canonicalJSON(a)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return fileutil.AtomicWriteFile(dest, bytes.NewReader(b), mode)
+	y, err := canonicalJSON(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(x, y), nil
 }
 
-// Merge merges the given index file into this index.
-//
-// This merges by name and version.
-//
-// If one of the entries in the given index does _not_ already exist, it is added.
-// In all other cases, the existing record is preserved.
-//
-// This can leave the index in an unsorted state
-func (i *IndexFile) Merge(f *IndexFile) {
-	for _, cvs := range f.Entries {
-		for _, cv := range cvs {
-			if !i.Has(cv.Name, cv.Version) {
-				e := i.Entries[cv.Name]
-				i.Entries[cv.Name] = append(e, cv)
-			}
-		}
+// canonicalJSON returns the JSON encoding of a sorted copy of the index.
+func canonicalJSON(i *IndexFile) ([]byte, error) {
+	c := i.shallowCopy()
+	c.SortEntries()
+	return json.Marshal(c)
+}
+
+// RoundTripStable reports whether writing the index file at path and loading
+// it again produces an equal index, as decided by IndexEqual.
+func RoundTripStable(path string) (bool, error) {
+	before, err := LoadIndexFile(path)
+	if err != nil {
+		return false, err
+	}
+	b, err := yaml.Marshal(before)
+	if err != nil {
+		return false, err
 	}
+	after, err := loadIndex(b, path)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reloading %s", path)
+	}
+	return IndexEqual(before, after)
 }
 
 // ChartVersion represents a chart entry in the IndexFile
+//
+// Helm releases load indices strictly, so a release that predates a field of
+// ChartVersion, such as Size, Notes or Extra, cannot read an index that sets it.
 type ChartVersion struct {
 	*chart.Metadata
 	URLs    []string  `json:"urls"`
@@ -272,6 +3195,18 @@ type ChartVersion struct {
 	Removed bool      `json:"removed,omitempty"`
 	Digest  string    `json:"digest,omitempty"`
 
+	// Size is the size of the chart archive in bytes, if known.
+	Size int64 `json:"size,omitempty"`
+
+	// Notes holds the human-readable release notes of the chart version. Helm
+	// does not interpret them.
+	Notes string `json:"notes,omitempty"`
+
+	// Extra holds arbitrary data attached to the chart version by other
+	// tooling. Helm does not interpret it, but preserves it when the index is
+	// loaded, merged, re-indexed or written.
+	Extra map[string]interface{} `json:"extra,omitempty"`
+
 	// ChecksumDeprecated is deprecated in Helm 3, and therefore ignored. Helm 3 replaced
 	// this with Digest. However, with a strict YAML parser enabled, a field must be
 	// present on the struct for backwards compatibility.
@@ -290,23 +3225,177 @@ type ChartVersion struct {
 	URLDeprecated string `json:"url,omitempty"`
 }
 
+// ReplacedBy returns the name of the chart that replaces this one, as recorded
+// in the AnnotationReplacedBy annotation.
+func (c *ChartVersion) ReplacedBy() (string, bool) {
+	if c.Metadata == nil {
+		return "", false
+	}
+	replacement, ok := c.Annotations[AnnotationReplacedBy]
+	return replacement, ok && replacement != ""
+}
+
+// ResolveURL returns the absolute download URL of the chart version, from the
+// first of its URLs.
+//
+// Absolute URLs are returned as is. Relative URLs are resolved against the
+// context path in info, on the scheme and host of repoBase, when the index
+// advertises one and repoBase has no path, and against repoBase otherwise, so
+// that a repoBase that already includes the context path or sits under a proxy
+// prefix is kept.
+func (c *ChartVersion) ResolveURL(repoBase string, info ServerInfo) (string, error) {
+	if len(c.URLs) == 0 {
+		return "", errors.Errorf("chart %s-%s has no downloadable URLs", c.Name, c.Version)
+	}
+	base := repoBase
+	if info.ContextPath != "" && info.ContextPath != "/" {
+		u, err := url.Parse(repoBase)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse %s as URL", repoBase)
+		}
+		if strings.TrimSuffix(u.Path, "/") == "" {
+			u.Path = "/" + strings.TrimPrefix(info.ContextPath, "/")
+			u.RawPath = ""
+			base = u.String()
+		}
+	}
+	return ResolveReferenceURL(base, c.URLs[0])
+}
+
+// ArtifactHubInfo holds the information Artifact Hub reads from the
+// artifacthub.io annotations of a chart.
+type ArtifactHubInfo struct {
+	// License is the SPDX identifier of the chart's license.
+	License string
+	// Changes lists the descriptions of the changes in this version.
+	Changes []string
+	// SignKey is the fingerprint of the key the chart is signed with.
+	SignKey string
+	// ContainersImages lists the container images the chart uses.
+	ContainersImages []string
+}
+
+// ArtifactHubInfo parses the well-known Artifact Hub annotations of the chart
+// version. Annotations that are missing or cannot be parsed are skipped and
+// leave the corresponding field empty.
+func (c *ChartVersion) ArtifactHubInfo() ArtifactHubInfo {
+	var info ArtifactHubInfo
+	if c.Metadata == nil {
+		return info
+	}
+
+	info.License = strings.TrimSpace(c.Annotations["artifacthub.io/license"])
+
+	// Changes are either plain strings or objects with a description.
+	if raw, ok := c.Annotations["artifacthub.io/changes"]; ok {
+		var changes []interface{}
+		if err := yaml.Unmarshal([]byte(raw), &changes); err == nil {
+			for _, change := range changes {
+				switch change := change.(type) {
+				case string:
+					info.Changes = append(info.Changes, change)
+				case map[string]interface{}:
+					if d, ok := change["description"].(string); ok && d != "" {
+						info.Changes = append(info.Changes, d)
+					}
+				}
+			}
+		}
+	}
+
+	if raw, ok := c.Annotations["artifacthub.io/signKey"]; ok {
+		var key struct {
+			Fingerprint string `json:"fingerprint"`
+		}
+		if err := yaml.Unmarshal([]byte(raw), &key); err == nil {
+			info.SignKey = key.Fingerprint
+		}
+	}
+
+	if raw, ok := c.Annotations["artifacthub.io/images"]; ok {
+		var images []struct {
+			Image string `json:"image"`
+		}
+		if err := yaml.Unmarshal([]byte(raw), &images); err == nil {
+			for _, image := range images {
+				if image.Image != "" {
+					info.ContainersImages = append(info.ContainersImages, image.Image)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// IndexDirectoryOptions configures how IndexDirectoryWithOptions indexes a
+// directory.
+type IndexDirectoryOptions struct {
+	// FollowSymlinks makes the indexer descend into symlinked subdirectories.
+	// By default, symlinked subdirectories are skipped, unlike with
+	// IndexDirectory, which always follows them. Either way, an archive
+	// reachable through more than one path is only indexed once.
+	FollowSymlinks bool
+
+	// RelativeURLs records the path of each archive relative to the indexed
+	// directory as its URL, ignoring the base URL. This keeps the index valid
+	// wherever the directory is moved to.
+	RelativeURLs bool
+
+	// Generated, if set, is used as the Generated time of the index and as the
+	// Created time of every indexed chart instead of the current time, so that
+	// indexing the same directory always produces the same index.
+	Generated time.Time
+
+	// URLTemplate, if set, is expanded for each chart to build its URL, in
+	// place of joining the base URL and the archive path. The placeholders
+	// {name}, {version} and {filename} are replaced with the chart name, the
+	// chart version and the archive file name.
+	URLTemplate string
+
+	// Clock, if set, is used by the index to tell the current time, as with
+	// WithClock. Generated takes precedence over it.
+	Clock func() time.Time
+
+	// RecordNotes records the release notes of each chart, as found by its
+	// AnnotationReleaseNotes annotation or a NOTES or NOTES.md file, in the
+	// Notes field of its entry.
+	RecordNotes bool
+
+	// RecordSize records the size of each chart archive in the Size field of
+	// its entry.
+	RecordSize bool
+}
+
 // IndexDirectory reads a (flat) directory and generates an index.
 //
-// It indexes only charts that have been packaged (*.tgz).
+// It indexes only charts that have been packaged (*.tgz), either directly in
+// dir or in one of its immediate subdirectories. Symlinked subdirectories are
+// followed, as they always have been; an archive reachable through more than
+// one path is only indexed once.
 //
 // The index returned will be in an unsorted state
 func IndexDirectory(dir, baseURL string) (*IndexFile, error) {
-	archives, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	return IndexDirectoryWithOptions(dir, baseURL, IndexDirectoryOptions{FollowSymlinks: true})
+}
+
+// IndexDirectoryWithOptions is like IndexDirectory, but lets the caller
+// configure how the directory is indexed.
+//
+// The index returned will be in an unsorted state
+func IndexDirectoryWithOptions(dir, baseURL string, opts IndexDirectoryOptions) (*IndexFile, error) {
+	archives, err := findArchives(dir, opts.FollowSymlinks)
 	if err != nil {
 		return nil, err
 	}
-	moreArchives, err := filepath.Glob(filepath.Join(dir, "**/*.tgz"))
-	if err != nil {
-		return nil, err
+
+	if opts.RelativeURLs {
+		baseURL = ""
 	}
-	archives = append(archives, moreArchives...)
 
-	index := NewIndexFile()
+	index := NewIndexFileWithOptions(WithClock(opts.Clock))
+	if !opts.Generated.IsZero() {
+		index.Generated = opts.Generated
+	}
 	for _, arch := range archives {
 		fname, err := filepath.Rel(dir, arch)
 		if err != nil {
@@ -334,22 +3423,235 @@ func IndexDirectory(dir, baseURL string) (*IndexFile, error) {
 		if err := index.MustAdd(c.Metadata, fname, parentURL, hash); err != nil {
 			return index, errors.Wrapf(err, "failed adding to %s to index", fname)
 		}
+		cvs := index.Entries[c.Name()]
+		cv := cvs[len(cvs)-1]
+		if opts.RecordSize {
+			fi, err := os.Stat(arch)
+			if err != nil {
+				return index, err
+			}
+			cv.Size = fi.Size()
+		}
+		if opts.RecordNotes {
+			cv.Notes = releaseNotes(c)
+		}
+		if !opts.Generated.IsZero() {
+			cv.Created = opts.Generated
+		}
+		if opts.URLTemplate != "" {
+			cv.URLs = []string{strings.NewReplacer(
+				"{name}", cv.Name,
+				"{version}", cv.Version,
+				"{filename}", fname,
+			).Replace(opts.URLTemplate)}
+		}
 	}
 	return index, nil
 }
 
+// releaseNotes returns the release notes of a chart, taken from its
+// AnnotationReleaseNotes annotation or else from a NOTES or NOTES.md file at
+// the root of the chart.
+func releaseNotes(c *chart.Chart) string {
+	if notes := c.Metadata.Annotations[AnnotationReleaseNotes]; notes != "" {
+		return notes
+	}
+	for _, name := range []string{"NOTES", "NOTES.md"} {
+		for _, f := range c.Files {
+			if f.Name == name {
+				return string(f.Data)
+			}
+		}
+	}
+	return ""
+}
+
+// AppendDirectory indexes the packaged charts in dir and adds them to the index
+// file at indexPath, which is created if it does not exist yet.
+//
+// Chart versions that are already in the index with the same digest keep
+// their existing entry, including its Created time. Versions whose archive
+// digest changed are replaced by the newly indexed entry. The updated index is
+// sorted and atomically written back to indexPath with the given mode.
+//
+// Use LoadAndIndexDirectory to inspect or modify the index before writing it.
+func AppendDirectory(indexPath, dir, baseURL string, mode os.FileMode) error {
+	i, err := LoadAndIndexDirectory(indexPath, dir, baseURL)
+	if err != nil {
+		return err
+	}
+	return i.WriteFile(indexPath, mode)
+}
+
+// LoadAndIndexDirectory loads the index file at indexPath, or starts a new one
+// if it does not exist, and adds the charts indexed from dir to it, the same
+// way AppendDirectory does. The combined index is sorted and returned without
+// being written.
+func LoadAndIndexDirectory(indexPath, dir, baseURL string) (*IndexFile, error) {
+	i, err := LoadIndexFile(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		i, err = NewIndexFile(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	indexed, err := IndexDirectory(dir, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	for name, cvs := range indexed.Entries {
+	Versions:
+		for _, cv := range cvs {
+			for idx, existing := range i.Entries[name] {
+				if existing.Version != cv.Version {
+					continue
+				}
+				if normalizeDigest(existing.Digest) != normalizeDigest(cv.Digest) {
+					cv.Extra = existing.Extra
+					i.Entries[name][idx] = cv
+				}
+				continue Versions
+			}
+			i.Entries[name] = append(i.Entries[name], cv)
+		}
+	}
+	i.SortEntries()
+	return i, nil
+}
+
+// findArchives returns the packaged charts (*.tgz) found in dir and in its
+// immediate subdirectories.
+//
+// Archives are deduplicated by their resolved path, so the same file is never
+// returned twice even when it can be reached through a symlink.
+func findArchives(dir string, followSymlinks bool) ([]string, error) {
+	var archives []string
+	seen := map[string]bool{}
+	add := func(path string) error {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if !seen[resolved] {
+			seen[resolved] = true
+			archives = append(archives, path)
+		}
+		return nil
+	}
+
+	// WalkDir does not descend into a root that is itself a symlink, so walk
+	// the resolved directory, but report archives under dir.
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(root, func(walked string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if walked == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, walked)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, rel)
+		topLevel := !strings.ContainsRune(rel, os.PathSeparator)
+
+		switch {
+		case d.IsDir():
+			if !topLevel {
+				return filepath.SkipDir
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			fi, err := os.Stat(path)
+			if err != nil {
+				// Dangling symlinks are ignored like any other non-chart file.
+				return nil
+			}
+			if !fi.IsDir() {
+				if strings.HasSuffix(d.Name(), ".tgz") {
+					return add(path)
+				}
+				return nil
+			}
+			if !topLevel || !followSymlinks {
+				return nil
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".tgz") && !e.IsDir() {
+					if err := add(filepath.Join(path, e.Name())); err != nil {
+						return err
+					}
+				}
+			}
+		case d.Type().IsRegular() && strings.HasSuffix(d.Name(), ".tgz"):
+			return add(path)
+		}
+		return nil
+	})
+	return archives, err
+}
+
+// ValidateIndexBytes validates the raw YAML or JSON data of an index file
+// against the given JSON Schema before it is decoded, catching structural
+// problems that loading the index tolerates. The returned error lists each
+// violation along with the path of the offending field.
+func ValidateIndexBytes(data []byte, schema []byte) (reterr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reterr = errors.Errorf("unable to validate schema: %s", r)
+		}
+	}()
+
+	if len(data) == 0 {
+		return ErrEmptyIndexYaml
+	}
+	indexJSON, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return errors.Wrap(err, "cannot convert index to JSON")
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(indexJSON))
+	if err != nil {
+		return errors.Wrap(err, "unable to validate schema")
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("index does not match the schema:\n")
+	for _, desc := range result.Errors() {
+		fmt.Fprintf(&sb, "- %s: %s\n", desc.Field(), desc.Description())
+	}
+	return errors.New(sb.String())
+}
+
 // loadIndex loads an index file and does minimal validity checking.
 //
 // The source parameter is only used for logging.
 // This will fail if API Version is not set (ErrNoAPIVersion) or if the unmarshal fails.
 func loadIndex(data []byte, source string) (*IndexFile, error) {
+	return loadIndexWith(data, source, jsonOrYamlUnmarshal)
+}
+
+// loadIndexWith is like loadIndex, but decodes the data with the given
+// unmarshal function instead of detecting the format.
+func loadIndexWith(data []byte, source string, unmarshal func([]byte, interface{}) error) (*IndexFile, error) {
 	i := &IndexFile{}
 
 	if len(data) == 0 {
 		return i, ErrEmptyIndexYaml
 	}
 
-	if err := jsonOrYamlUnmarshal(data, i); err != nil {
+	if err := unmarshal(data, i); err != nil {
 		return i, err
 	}
 
@@ -393,6 +3695,12 @@ func jsonOrYamlUnmarshal(b []byte, i interface{}) error {
 	return yaml.UnmarshalStrict(b, i)
 }
 
+// yamlUnmarshalStrict strictly unmarshals the given YAML byte slice into the
+// provided interface.
+func yamlUnmarshalStrict(b []byte, i interface{}) error {
+	return yaml.UnmarshalStrict(b, i)
+}
+
 // ignoreSkippableChartValidationError inspect the given error and returns nil if
 // the error isn't important for index loading
 //
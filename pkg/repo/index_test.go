@@ -19,16 +19,28 @@ package repo
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"       //nolint
+	"golang.org/x/crypto/openpgp/armor" //nolint
+	"sigs.k8s.io/yaml"
 
 	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/helmpath"
@@ -77,6 +89,29 @@ entries:
 `
 )
 
+// addCharts adds each of mds to i, as an archive named after the chart name and
+// version under http://example.com/charts.
+func addCharts(t *testing.T, i *IndexFile, mds ...*chart.Metadata) {
+	t.Helper()
+	for _, md := range mds {
+		if err := i.MustAdd(md, md.Name+"-"+md.Version+".tgz", "http://example.com/charts", "sha256:1234567890"); err != nil {
+			t.Fatalf("unexpected error adding to index: %s", err)
+		}
+	}
+}
+
+// indexOfVersions returns an index with an entry for each listed version of
+// each chart, in the order given.
+func indexOfVersions(versions map[string][]string) *IndexFile {
+	i := NewIndexFile()
+	for name, vs := range versions {
+		for _, v := range vs {
+			i.Entries[name] = append(i.Entries[name], &ChartVersion{Metadata: &chart.Metadata{Name: name, Version: v}})
+		}
+	}
+	return i
+}
+
 func TestIndexFile(t *testing.T) {
 	i := NewIndexFile()
 	for _, x := range []struct {
@@ -138,6 +173,168 @@ func TestIndexFile(t *testing.T) {
 	}
 }
 
+func TestChartVersionsNewer(t *testing.T) {
+	cvs := ChartVersions{}
+	for _, v := range []string{"0.1.0", "0.3.0", "not-a-version", "0.2.0", "0.2.0-beta.1", "0.1.5"} {
+		cvs = append(cvs, &ChartVersion{Metadata: &chart.Metadata{Name: "cutter", Version: v}})
+	}
+
+	newer, err := cvs.Newer("0.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, cv := range newer {
+		got = append(got, cv.Version)
+	}
+	if expect := "0.3.0 0.2.0 0.2.0-beta.1"; strings.Join(got, " ") != expect {
+		t.Errorf("Expected %q, got %q", expect, strings.Join(got, " "))
+	}
+
+	if newer, err := cvs.Newer("0.3.0"); err != nil || len(newer) != 0 {
+		t.Errorf("Expected no newer versions, got %v (%v)", newer, err)
+	}
+
+	if _, err := cvs.Newer("latest"); err == nil {
+		t.Error("Expected an error for an invalid version")
+	}
+}
+
+func TestChartVersionsPrevious(t *testing.T) {
+	cvs := ChartVersions{}
+	for _, v := range []string{"0.1.0", "0.3.0", "not-a-version", "0.2.0", "0.3.0-beta.1", "0.1.5"} {
+		cvs = append(cvs, &ChartVersion{Metadata: &chart.Metadata{Name: "cutter", Version: v}})
+	}
+
+	for version, expect := range map[string]string{
+		"0.3.0":        "0.2.0",
+		"0.3.0-beta.1": "0.2.0",
+		"0.2.0":        "0.1.5",
+		"0.1.1":        "0.1.0",
+	} {
+		prev, err := cvs.Previous(version)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", version, err)
+			continue
+		}
+		if prev.Version != expect {
+			t.Errorf("Expected %s before %s, got %s", expect, version, prev.Version)
+		}
+	}
+
+	if _, err := cvs.Previous("0.1.0"); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion for the oldest version, got %v", err)
+	}
+	if _, err := cvs.Previous("latest"); err == nil {
+		t.Error("Expected an error for an invalid version")
+	}
+}
+
+func TestChartVersionsUpgradePath(t *testing.T) {
+	cvs := ChartVersions{}
+	for _, v := range []string{"1.3.2", "1.0.0", "1.2.0", "bad", "1.3.0-rc.1", "1.1.0", "1.4.0", "2.0.0-beta.1"} {
+		cvs = append(cvs, &ChartVersion{Metadata: &chart.Metadata{Name: "stepper", Version: v}})
+	}
+
+	versions := func(path ChartVersions) string {
+		var out []string
+		for _, cv := range path {
+			out = append(out, cv.Version)
+		}
+		return strings.Join(out, ",")
+	}
+
+	for _, tc := range []struct{ from, to, expect string }{
+		{"1.0.0", "1.3.2", "1.1.0,1.2.0,1.3.2"},
+		{"1.2.0", "1.4.0", "1.3.2,1.4.0"},
+		{"0.9.0", "1.1.0", "1.0.0,1.1.0"},
+		{"1.4.0", "2.0.0-beta.1", "2.0.0-beta.1"},
+	} {
+		path, err := cvs.UpgradePath(tc.from, tc.to)
+		if err != nil {
+			t.Errorf("Unexpected error from %s to %s: %s", tc.from, tc.to, err)
+			continue
+		}
+		if got := versions(path); got != tc.expect {
+			t.Errorf("From %s to %s: expected %s, got %s", tc.from, tc.to, tc.expect, got)
+		}
+	}
+
+	for _, tc := range []struct{ from, to string }{
+		{"1.0.0", "1.3.1"},
+		{"1.3.2", "1.0.0"},
+		{"bad", "1.3.2"},
+		{"1.0.0", "latest"},
+	} {
+		if _, err := cvs.UpgradePath(tc.from, tc.to); err == nil {
+			t.Errorf("Expected an error from %s to %s", tc.from, tc.to)
+		}
+	}
+}
+
+func TestSortEntriesBy(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newIndex := func() *IndexFile {
+		i := NewIndexFile()
+		for idx, v := range []string{"0.2.0", "bad", "0.10.0", "0.1.0"} {
+			i.Entries["cutter"] = append(i.Entries["cutter"], &ChartVersion{
+				Metadata: &chart.Metadata{Name: "cutter", Version: v},
+				Created:  base.Add(time.Duration(idx) * time.Hour),
+			})
+		}
+		return i
+	}
+
+	for _, tc := range []struct {
+		order  SortOrder
+		expect string
+	}{
+		{SortSemverDesc, "0.10.0 0.2.0 0.1.0 bad"},
+		{SortSemverAsc, "0.1.0 0.2.0 0.10.0 bad"},
+		{SortCreatedDesc, "0.1.0 0.10.0 bad 0.2.0"},
+		{SortCreatedAsc, "0.2.0 bad 0.10.0 0.1.0"},
+	} {
+		i := newIndex()
+		i.SortEntriesBy(tc.order)
+		var got []string
+		for _, cv := range i.Entries["cutter"] {
+			got = append(got, cv.Version)
+		}
+		if strings.Join(got, " ") != tc.expect {
+			t.Errorf("Order %d: expected %q, got %q", tc.order, tc.expect, strings.Join(got, " "))
+		}
+	}
+}
+
+func TestChartVersionsGetByAppVersion(t *testing.T) {
+	cvs := ChartVersions{}
+	for _, x := range [][2]string{
+		{"1.0.0", "14.2"},
+		{"1.1.0", "15.1"},
+		{"1.3.0", "15.4"},
+		{"1.2.0", "15.5"},
+		{"2.0.0", "16.0"},
+		{"2.1.0", "latest"},
+	} {
+		cvs = append(cvs, &ChartVersion{Metadata: &chart.Metadata{Name: "postgres", Version: x[0], AppVersion: x[1]}})
+	}
+
+	cv, err := cvs.GetByAppVersion("15.x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv.Version != "1.3.0" {
+		t.Errorf("Expected chart version 1.3.0, got %s", cv.Version)
+	}
+
+	if _, err := cvs.GetByAppVersion("17.x"); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion, got %v", err)
+	}
+	if _, err := cvs.GetByAppVersion("not a constraint"); err == nil {
+		t.Error("Expected an error for an invalid constraint")
+	}
+}
+
 func TestLoadIndex(t *testing.T) {
 
 	tests := []struct {
@@ -171,6 +368,341 @@ func TestLoadIndex(t *testing.T) {
 	}
 }
 
+func TestValidateIndexBytes(t *testing.T) {
+	schema := []byte(`{
+  "type": "object",
+  "required": ["apiVersion", "entries"],
+  "properties": {
+    "apiVersion": {"type": "string"},
+    "entries": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "array",
+        "items": {
+          "type": "object",
+          "required": ["version"],
+          "properties": {"version": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`)
+
+	valid := []byte("apiVersion: v1\nentries:\n  shape:\n  - name: shape\n    version: 1.0.0\n")
+	if err := ValidateIndexBytes(valid, schema); err != nil {
+		t.Errorf("Expected a valid index, got %s", err)
+	}
+
+	invalid := []byte("apiVersion: v1\nentries:\n  shape:\n  - name: shape\n    version: 1.0\n  bare:\n  - name: bare\n")
+	err := ValidateIndexBytes(invalid, schema)
+	if err == nil {
+		t.Fatal("Expected schema violations")
+	}
+	for _, field := range []string{"entries.shape.0.version", "entries.bare.0"} {
+		if !strings.Contains(err.Error(), "- "+field+": ") {
+			t.Errorf("Expected a violation for %s, got %s", field, err)
+		}
+	}
+
+	if err := ValidateIndexBytes(nil, schema); err != ErrEmptyIndexYaml {
+		t.Errorf("Expected ErrEmptyIndexYaml, got %v", err)
+	}
+	if err := ValidateIndexBytes(valid, []byte("{not json")); err == nil {
+		t.Error("Expected an invalid schema to be reported")
+	}
+}
+
+func TestLoadIndexFromURL(t *testing.T) {
+	srv, err := startLocalServerForTests(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	abs, err := filepath.Abs(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rawurl := range []string{srv.URL + "/index.yaml", "file://" + filepath.ToSlash(abs)} {
+		i, err := LoadIndexFromURL(context.Background(), rawurl, nil)
+		if err != nil {
+			t.Errorf("Unexpected error loading %s: %s", rawurl, err)
+			continue
+		}
+		verifyLocalIndex(t, i)
+	}
+
+	data, err := os.ReadFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched string
+	transports := map[string]IndexTransport{
+		"sftp": IndexTransportFunc(func(_ context.Context, u *url.URL) ([]byte, error) {
+			fetched = u.Host + u.Path
+			return data, nil
+		}),
+	}
+	i, err := LoadIndexFromURL(context.Background(), "sftp://charts.example.com/srv/index.yaml", transports)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fetched != "charts.example.com/srv/index.yaml" {
+		t.Errorf("Expected the sftp transport to be used, got %q", fetched)
+	}
+	verifyLocalIndex(t, i)
+
+	if _, err := LoadIndexFromURL(context.Background(), "gopher://example.com/index.yaml", transports); err == nil {
+		t.Error("Expected an error for a scheme without a transport")
+	}
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if _, err := LoadIndexFromURL(context.Background(), notFound.URL+"/index.yaml", nil); err == nil {
+		t.Error("Expected an error for a missing index")
+	}
+}
+
+func TestParseServerInfo(t *testing.T) {
+	i, err := LoadIndexFile(chartmuseumtestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := i.ParseServerInfo()
+	if !info.Present || info.ContextPath != "/v1/helm" || info.Version != "" {
+		t.Errorf("Unexpected server info %+v", info)
+	}
+	if _, ok := i.ServerInfo["contextPath"]; !ok {
+		t.Error("Expected the raw server info to be kept")
+	}
+
+	i.ServerInfo = map[string]interface{}{"contextPath": 42, "version": "v0.16.0"}
+	if info := i.ParseServerInfo(); info.ContextPath != "" || info.Version != "v0.16.0" {
+		t.Errorf("Unexpected server info %+v", info)
+	}
+
+	if info := NewIndexFile().ParseServerInfo(); info.Present {
+		t.Errorf("Expected no server info, got %+v", info)
+	}
+}
+
+func TestLoadIndexFromResponse(t *testing.T) {
+	yamlData, err := os.ReadFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := os.ReadFile(jsonTestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"yaml content type", "text/yaml", yamlData},
+		{"yaml content type with parameters", "application/x-yaml; charset=utf-8", yamlData},
+		{"json content type", "application/json", jsonData},
+		{"no content type with yaml", "", yamlData},
+		{"no content type with json", "", jsonData},
+		{"unknown content type", "application/octet-stream", yamlData},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{},
+				Body:   io.NopCloser(bytes.NewReader(tc.data)),
+			}
+			if tc.contentType != "" {
+				resp.Header.Set("Content-Type", tc.contentType)
+			}
+			i, err := LoadIndexFromResponse(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyLocalIndex(t, i)
+		})
+	}
+
+	t.Run("json content type with yaml body", func(t *testing.T) {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body:   io.NopCloser(bytes.NewReader(yamlData)),
+		}
+		if _, err := LoadIndexFromResponse(resp); err == nil {
+			t.Error("expected an error parsing YAML served as JSON")
+		}
+	})
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, tc := range []struct {
+		encoding string
+		data     []byte
+	}{
+		{"gzip", gzipped(yamlData)},
+		{"x-gzip", gzipped(yamlData)},
+		{"GZIP", gzipped(jsonData)},
+		{"gzip, identity", gzipped(yamlData)},
+		{"gzip, gzip", gzipped(gzipped(yamlData))},
+	} {
+		t.Run("content encoding "+tc.encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{"Content-Encoding": []string{tc.encoding}},
+				Body:   io.NopCloser(bytes.NewReader(tc.data)),
+			}
+			i, err := LoadIndexFromResponse(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyLocalIndex(t, i)
+		})
+	}
+
+	t.Run("gzip content encoding with plain body", func(t *testing.T) {
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:   io.NopCloser(bytes.NewReader(yamlData)),
+		}
+		if _, err := LoadIndexFromResponse(resp); err == nil {
+			t.Error("expected an error decompressing a plain body")
+		}
+	})
+
+	t.Run("unsupported content encoding", func(t *testing.T) {
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"br"}},
+			Body:   io.NopCloser(bytes.NewReader(yamlData)),
+		}
+		if _, err := LoadIndexFromResponse(resp); err == nil {
+			t.Error("expected an error for an unsupported content encoding")
+		}
+	})
+}
+
+func TestPeekLatest(t *testing.T) {
+	for _, f := range []string{testfile, unorderedTestfile, jsonTestfile} {
+		cv, err := PeekLatest(f, "nginx")
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		if cv.Version != "0.2.0" {
+			t.Errorf("%s: expected nginx 0.2.0, got %s", f, cv.Version)
+		}
+		if len(cv.URLs) != 1 || cv.URLs[0] != "https://charts.helm.sh/stable/nginx-0.2.0.tgz" {
+			t.Errorf("%s: unexpected URLs %v", f, cv.URLs)
+		}
+
+		if _, err := PeekLatest(f, "missing"); err != ErrNoChartName {
+			t.Errorf("%s: expected ErrNoChartName, got %v", f, err)
+		}
+	}
+
+	// Everything after the requested chart is never parsed.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.yaml")
+	data := `apiVersion: v1
+entries:
+  cutter:
+  - name: cutter
+    version: 0.2.0-beta.1
+    urls:
+    - https://example.com/cutter-0.2.0-beta.1.tgz
+  - name: cutter
+    description: |
+      A multi-line
+      description.
+    version: 0.1.0
+    urls:
+    - https://example.com/cutter-0.1.0.tgz
+  setter: {{ this is not valid YAML
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cv, err := PeekLatest(path, "cutter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv.Version != "0.1.0" {
+		t.Errorf("Expected the latest stable cutter 0.1.0, got %s", cv.Version)
+	}
+	if !strings.HasPrefix(cv.Description, "A multi-line") {
+		t.Errorf("Unexpected description %q", cv.Description)
+	}
+}
+
+func TestLoadIndexFileWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, i *IndexFile) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFile(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	index := func(digest string, includes []string, names ...string) *IndexFile {
+		t.Helper()
+		i := NewIndexFile()
+		i.Include = includes
+		for _, name := range names {
+			if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: name, Version: "0.1.0"}, name+"-0.1.0.tgz", "http://example.com", digest); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		return i
+	}
+
+	base := write("index.yaml", index("base", []string{"teams/a.yaml", "file://" + filepath.Join(dir, "b.yaml")}, "core"))
+	write("teams/a.yaml", index("a", []string{"../c.yaml"}, "core", "alpha"))
+	write("b.yaml", index("b", nil, "alpha", "bravo"))
+	write("c.yaml", index("c", nil, "charlie"))
+
+	i, err := LoadIndexFileWithIncludes(base)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for name, digest := range map[string]string{"core": "base", "alpha": "a", "bravo": "b", "charlie": "c"} {
+		cv, err := i.Get(name, "0.1.0")
+		if err != nil {
+			t.Errorf("Expected %s to be loaded: %s", name, err)
+			continue
+		}
+		if cv.Digest != digest {
+			t.Errorf("Expected %s to come from %s, got %s", name, digest, cv.Digest)
+		}
+	}
+	if i.Include != nil {
+		t.Errorf("Expected includes to be cleared, got %v", i.Include)
+	}
+
+	cycle := write("cycle.yaml", index("x", []string{"loop.yaml"}, "x"))
+	write("loop.yaml", index("y", []string{"cycle.yaml"}, "y"))
+	if _, err := LoadIndexFileWithIncludes(cycle); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expected an include cycle error, got %v", err)
+	}
+
+	remote := write("remote.yaml", index("r", []string{"https://example.com/index.yaml"}, "r"))
+	if _, err := LoadIndexFileWithIncludes(remote); err == nil {
+		t.Error("Expected an error for a remote include")
+	}
+}
+
 // TestLoadIndex_Duplicates is a regression to make sure that we don't non-deterministically allow duplicate packages.
 func TestLoadIndex_Duplicates(t *testing.T) {
 	if _, err := loadIndex([]byte(indexWithDuplicates), "indexWithDuplicates"); err == nil {
@@ -178,6 +710,38 @@ func TestLoadIndex_Duplicates(t *testing.T) {
 	}
 }
 
+func TestLoadIndexFileRepair(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.yaml")
+	if err := os.WriteFile(path, []byte(indexWithDuplicates), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadIndexFile(path); err == nil {
+		t.Fatal("Expected an error loading an index with duplicate entries")
+	}
+
+	i, notes, err := LoadIndexFileRepair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 {
+		t.Errorf("Expected 1 repair note, got %v", notes)
+	}
+	if l := len(i.Entries["nginx"]); l != 2 {
+		t.Errorf("Expected 2 merged nginx entries, got %d", l)
+	}
+
+	i, notes, err = LoadIndexFileRepair(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 0 {
+		t.Errorf("Expected no repair notes, got %v", notes)
+	}
+	verifyLocalIndex(t, i)
+}
+
 func TestLoadIndex_EmptyEntry(t *testing.T) {
 	if _, err := loadIndex([]byte(indexWithEmptyEntry), "indexWithEmptyEntry"); err != nil {
 		t.Errorf("unexpected error: %s", err)
@@ -253,256 +817,2548 @@ func TestMerge(t *testing.T) {
 
 }
 
-func TestDownloadIndexFile(t *testing.T) {
-	t.Run("should  download index file", func(t *testing.T) {
-		srv, err := startLocalServerForTests(nil)
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer srv.Close()
+func TestMapURLs(t *testing.T) {
+	i := NewIndexFile()
+	addCharts(t, i,
+		&chart.Metadata{APIVersion: "v2", Name: "clipper", Version: "0.1.0"},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0"},
+		&chart.Metadata{APIVersion: "v2", Name: "setter", Version: "0.1.8"},
+	)
 
-		r, err := NewChartRepository(&Entry{
-			Name: testRepo,
-			URL:  srv.URL,
-		}, getter.All(&cli.EnvSettings{}))
-		if err != nil {
-			t.Errorf("Problem creating chart repository from %s: %v", testRepo, err)
-		}
+	i.Entries["cutter"] = append(i.Entries["cutter"], nil, &ChartVersion{})
 
-		idx, err := r.DownloadIndexFile()
-		if err != nil {
-			t.Fatalf("Failed to download index file to %s: %#v", idx, err)
+	i.MapURLs(func(chartName, version, u string) string {
+		if chartName == "setter" {
+			return ""
 		}
+		return strings.Replace(u, "/charts/", "/charts/"+chartName+"/", 1)
+	})
 
-		if _, err := os.Stat(idx); err != nil {
+	for name, expect := range map[string]string{
+		"clipper": "http://example.com/charts/clipper/clipper-0.1.0.tgz",
+		"cutter":  "http://example.com/charts/cutter/cutter-0.2.0.tgz",
+	} {
+		if got := i.Entries[name][0].URLs; len(got) != 1 || got[0] != expect {
+			t.Errorf("Expected %s URLs to be [%s], got %v", name, expect, got)
+		}
+	}
+	if got := i.Entries["setter"][0].URLs; len(got) != 0 {
+		t.Errorf("Expected setter URLs to be dropped, got %v", got)
+	}
+}
+
+func TestAPIVersionBreakdown(t *testing.T) {
+	i, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.MustAdd(&chart.Metadata{Name: "legacy", Version: "0.1.0"}, "legacy-0.1.0.tgz", "http://example.com/charts", "sha256:1234567890"); err != nil {
+		t.Fatalf("unexpected error adding to index: %s", err)
+	}
+
+	breakdown := i.APIVersionBreakdown()
+	if len(breakdown) != 2 {
+		t.Fatalf("Expected 2 API versions, got %v", breakdown)
+	}
+	if breakdown[chart.APIVersionV2] != 4 {
+		t.Errorf("Expected 4 %s entries, got %d", chart.APIVersionV2, breakdown[chart.APIVersionV2])
+	}
+	if breakdown[chart.APIVersionV1] != 1 {
+		t.Errorf("Expected 1 %s entry, got %d", chart.APIVersionV1, breakdown[chart.APIVersionV1])
+	}
+}
+
+func TestAnnotateLatestStable(t *testing.T) {
+	i := NewIndexFile()
+	addCharts(t, i,
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0"},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0", Annotations: map[string]string{"foo": "bar"}},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.3.0-rc.1"},
+		&chart.Metadata{APIVersion: "v2", Name: "setter", Version: "0.1.0-alpha"},
+	)
+
+	i.Entries["cutter"] = append(i.Entries["cutter"], nil, &ChartVersion{})
+
+	i.AnnotateLatestStable()
+	i.AnnotateLatestStable()
+
+	for _, cv := range i.Entries["cutter"][:3] {
+		if got := cv.Annotations[AnnotationLatestStable]; got != "0.2.0" {
+			t.Errorf("Expected cutter %s to be annotated with 0.2.0, got %q", cv.Version, got)
+		}
+	}
+	if got := i.Entries["cutter"][1].Annotations["foo"]; got != "bar" {
+		t.Errorf("Expected existing annotations to be preserved, got %q", got)
+	}
+	if _, ok := i.Entries["setter"][0].Annotations[AnnotationLatestStable]; ok {
+		t.Error("Expected setter to have no latest stable annotation")
+	}
+}
+
+func TestFilterByMaintainer(t *testing.T) {
+	i := NewIndexFile()
+	i.Annotations = map[string]string{"helm.sh/test": "foo"}
+	helm := &chart.Maintainer{Name: "The Helm Team", Email: "helm@example.com"}
+	other := &chart.Maintainer{Name: "Someone Else", Email: "nobody@example.com"}
+	addCharts(t, i,
+		&chart.Metadata{APIVersion: "v2", Name: "clipper", Version: "0.1.0", Maintainers: []*chart.Maintainer{helm, other}},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0", Maintainers: []*chart.Maintainer{helm}},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0", Maintainers: []*chart.Maintainer{other}},
+		&chart.Metadata{APIVersion: "v2", Name: "setter", Version: "0.1.0"},
+	)
+
+	for _, query := range []string{"HELM@example.com", "the helm team"} {
+		filtered := i.FilterByMaintainer(query)
+		if len(filtered.Entries) != 2 {
+			t.Fatalf("Expected 2 charts for %q, got %d", query, len(filtered.Entries))
+		}
+		if cvs := filtered.Entries["cutter"]; len(cvs) != 1 || cvs[0].Version != "0.1.0" {
+			t.Errorf("Expected only cutter 0.1.0 for %q, got %v", query, cvs)
+		}
+		if _, ok := filtered.Entries["setter"]; ok {
+			t.Errorf("Expected setter to be dropped for %q", query)
+		}
+		if filtered.Annotations["helm.sh/test"] != "foo" {
+			t.Error("Expected index annotations to be copied")
+		}
+	}
+
+	if len(i.Entries["cutter"]) != 2 {
+		t.Error("Expected the source index to be left untouched")
+	}
+}
+
+func TestMergeUpdateGenerated(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	for _, tc := range []struct {
+		name     string
+		base     time.Time
+		other    time.Time
+		opts     MergeOptions
+		expected time.Time
+	}{
+		{"default keeps receiver", older, newer, MergeOptions{}, older},
+		{"update to newer", older, newer, MergeOptions{UpdateGenerated: true}, newer},
+		{"receiver already newer", newer, older, MergeOptions{UpdateGenerated: true}, newer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ind1 := NewIndexFile()
+			ind1.Generated = tc.base
+			ind2 := NewIndexFile()
+			ind2.Generated = tc.other
+			if err := ind2.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "doughnut", Version: "0.2.0"}, "doughnut-0.2.0.tgz", "http://example.com", "ccccbbbb"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ind1.MergeWithOptions(ind2, tc.opts)
+
+			if !ind1.Generated.Equal(tc.expected) {
+				t.Errorf("Expected generated time %s, got %s", tc.expected, ind1.Generated)
+			}
+			if !ind1.Has("doughnut", "0.2.0") {
+				t.Error("Expected doughnut 0.2.0 to be merged")
+			}
+		})
+	}
+}
+
+func TestMergePreferSigned(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		opts           MergeOptions
+		existingDigest string
+		otherDigest    string
+		expected       string
+	}{
+		{"keep signed existing", MergeOptions{Strategy: MergeOverwrite, PreferSigned: true}, "aaaa", "", "aaaa"},
+		{"take signed other", MergeOptions{PreferSigned: true}, "", "bbbb", "bbbb"},
+		{"both signed keeps existing", MergeOptions{PreferSigned: true}, "aaaa", "bbbb", "aaaa"},
+		{"both signed overwrites", MergeOptions{Strategy: MergeOverwrite, PreferSigned: true}, "aaaa", "bbbb", "bbbb"},
+		{"neither signed overwrites", MergeOptions{Strategy: MergeOverwrite, PreferSigned: true}, "", "", ""},
+		{"disabled keeps existing", MergeOptions{}, "", "bbbb", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ind1 := NewIndexFile()
+			if err := ind1.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "dreadnought", Version: "0.1.0"}, "dreadnought-0.1.0.tgz", "http://one.example.com", tc.existingDigest); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			ind2 := NewIndexFile()
+			if err := ind2.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "dreadnought", Version: "0.1.0"}, "dreadnought-0.1.0.tgz", "http://two.example.com", tc.otherDigest); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ind1.MergeWithOptions(ind2, tc.opts)
+
+			cvs := ind1.Entries["dreadnought"]
+			if len(cvs) != 1 {
+				t.Fatalf("Expected 1 entry, got %d", len(cvs))
+			}
+			if cvs[0].Digest != tc.expected {
+				t.Errorf("Expected digest %q, got %q", tc.expected, cvs[0].Digest)
+			}
+		})
+	}
+}
+
+func TestMergeRecordSuperseded(t *testing.T) {
+	newIndex := func(url string, versions ...string) *IndexFile {
+		i := NewIndexFile()
+		for _, v := range versions {
+			if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "curated", Version: v}, "curated-"+v+".tgz", url, "aaaa"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		return i
+	}
+
+	ind1 := newIndex("http://one.example.com", "0.1.0", "0.2.0")
+	old := ind1.Entries["curated"][0]
+	result := ind1.MergeWithOptions(newIndex("http://two.example.com", "0.1.0", "0.3.0"), MergeOptions{Strategy: MergeOverwrite, RecordSuperseded: true})
+	if len(result.Superseded) != 1 || result.Superseded[0] != old {
+		t.Fatalf("Expected the replaced 0.1.0 entry to be recorded, got %v", result.Superseded)
+	}
+	if result.Superseded[0].URLs[0] != "http://one.example.com/curated-0.1.0.tgz" {
+		t.Errorf("Expected the superseded entry to keep its URL, got %v", result.Superseded[0].URLs)
+	}
+
+	ind1 = newIndex("http://one.example.com", "0.1.0")
+	result = ind1.MergeWithOptions(newIndex("http://two.example.com", "0.1.0"), MergeOptions{Strategy: MergeOverwrite})
+	if result.Superseded != nil {
+		t.Errorf("Expected nothing to be recorded by default, got %v", result.Superseded)
+	}
+}
+
+func TestMergeCharts(t *testing.T) {
+	ind1 := NewIndexFile()
+	if err := ind1.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "curated", Version: "0.1.0"}, "curated-0.1.0.tgz", "http://local.example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	upstream := NewIndexFile()
+	for _, md := range []*chart.Metadata{
+		{APIVersion: "v2", Name: "curated", Version: "0.1.0"},
+		{APIVersion: "v2", Name: "curated", Version: "0.2.0"},
+		{APIVersion: "v2", Name: "uncurated", Version: "1.0.0"},
+	} {
+		if err := upstream.MustAdd(md, md.Name+"-"+md.Version+".tgz", "http://upstream.example.com", "bbbb"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	ind1.MergeCharts(upstream, []string{"curated", "absent"}, MergeOverwrite)
+
+	if len(ind1.Entries) != 1 {
+		t.Fatalf("Expected only curated to be merged, got %d charts", len(ind1.Entries))
+	}
+	if len(ind1.Entries["curated"]) != 2 {
+		t.Fatalf("Expected 2 curated versions, got %d", len(ind1.Entries["curated"]))
+	}
+	cv, err := ind1.Get("curated", "0.1.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cv.Digest != "bbbb" {
+		t.Errorf("Expected curated 0.1.0 to be overwritten, got digest %q", cv.Digest)
+	}
+}
+
+func TestMergeToFile(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []string
+	var expected *IndexFile
+	for n, charts := range [][]string{{"apple", "banana"}, {"banana", "cherry"}, {"cherry", "damson"}} {
+		i := NewIndexFile()
+		for _, name := range charts {
+			if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: name, Version: "0.1.0"}, name+"-0.1.0.tgz", fmt.Sprintf("http://%d.example.com", n), "aaaa"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		p := filepath.Join(dir, fmt.Sprintf("index-%d.yaml", n))
+		if err := i.WriteFile(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, p)
+
+		loaded, err := LoadIndexFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			expected = loaded
+		} else {
+			expected.Merge(loaded)
+		}
+	}
+	expected.SortEntries()
+
+	dest := filepath.Join(dir, "merged.yaml")
+	if err := MergeToFile(dest, 0644, inputs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	merged, err := LoadIndexFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, err := IndexEqual(merged, expected); err != nil || !equal {
+		t.Errorf("Expected the merged file to match an in-memory merge, got %v, %v", equal, err)
+	}
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := yaml.Marshal(expected); err != nil || string(b) != string(want) {
+		t.Errorf("Expected the merged file to be written like WriteFile\nexpected:\n%s\ngot:\n%s", want, b)
+	}
+	if cv, _ := merged.Get("banana", "0.1.0"); cv == nil || cv.URLs[0] != "http://0.example.com/banana-0.1.0.tgz" {
+		t.Errorf("Expected the first input to win for banana, got %v", cv)
+	}
+
+	if err := MergeToFile(dest, 0644, []string{filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("Expected an error for a missing input")
+	}
+
+	// Versions are merged under their entry key, even if their metadata
+	// names another chart.
+	inputs = nil
+	for n, version := range []string{"0.1.0", "0.2.0", "0.1.0"} {
+		i := NewIndexFile()
+		i.Entries["alias"] = ChartVersions{{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "real", Version: version},
+			URLs:     []string{fmt.Sprintf("http://%d.example.com/real-%s.tgz", n, version)},
+		}}
+		p := filepath.Join(dir, fmt.Sprintf("alias-%d.yaml", n))
+		if err := i.WriteFile(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, p)
+	}
+	if err := MergeToFile(dest, 0644, inputs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	merged, err = LoadIndexFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cvs := merged.Entries["alias"]
+	if len(cvs) != 2 || cvs[0].Version != "0.2.0" || cvs[1].URLs[0] != "http://0.example.com/real-0.1.0.tgz" {
+		t.Errorf("Expected both versions under alias with the first input winning, got %v", cvs)
+	}
+}
+
+func TestGetByTrack(t *testing.T) {
+	i := NewIndexFile()
+	for _, x := range []struct{ version, track string }{
+		{"1.0.0", "stable"},
+		{"1.1.0", "stable"},
+		{"1.2.0-beta.1", "beta"},
+		{"1.2.0-rc.1", "canary"},
+		{"1.3.0", ""},
+		{"not-a-version", "stable"},
+	} {
+		annotations := map[string]string{}
+		if x.track != "" {
+			annotations[AnnotationTrack] = x.track
+		}
+		i.Entries["tracker"] = append(i.Entries["tracker"], &ChartVersion{Metadata: &chart.Metadata{Name: "tracker", Version: x.version, Annotations: annotations}})
+	}
+
+	for track, expect := range map[string]string{"stable": "1.1.0", "beta": "1.2.0-beta.1", "canary": "1.2.0-rc.1"} {
+		cv, err := i.GetByTrack("tracker", track)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", track, err)
+			continue
+		}
+		if cv.Version != expect {
+			t.Errorf("Expected %s on %s, got %s", expect, track, cv.Version)
+		}
+	}
+	if _, err := i.GetByTrack("tracker", "nightly"); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion, got %v", err)
+	}
+	if _, err := i.GetByTrack("absent", "stable"); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+}
+
+func TestRenameChart(t *testing.T) {
+	newIndex := func(t *testing.T) *IndexFile {
+		t.Helper()
+		i := NewIndexFile()
+		for _, md := range []*chart.Metadata{
+			{APIVersion: "v2", Name: "foo", Version: "0.1.0"},
+			{APIVersion: "v2", Name: "foo", Version: "0.2.0"},
+			{APIVersion: "v2", Name: "bar", Version: "0.2.0"},
+			{APIVersion: "v2", Name: "bar", Version: "0.3.0"},
+		} {
+			if err := i.MustAdd(md, md.Name+"-"+md.Version+".tgz", "http://example.com", md.Name); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		return i
+	}
+
+	i := newIndex(t)
+	if err := i.RenameChart("foo", "baz"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := i.Entries["foo"]; ok {
+		t.Error("Expected foo to be removed")
+	}
+	for _, cv := range i.Entries["baz"] {
+		if cv.Name != "baz" {
+			t.Errorf("Expected the metadata name to be baz, got %s", cv.Name)
+		}
+	}
+	if len(i.Entries["baz"]) != 2 {
+		t.Errorf("Expected 2 baz versions, got %d", len(i.Entries["baz"]))
+	}
+
+	i = newIndex(t)
+	if err := i.RenameChart("foo", "bar"); err == nil {
+		t.Error("Expected an error renaming onto an existing chart")
+	}
+	if len(i.Entries["foo"]) != 2 || i.Entries["foo"][0].Name != "foo" {
+		t.Error("Expected a failed rename to leave the index untouched")
+	}
+	for _, name := range []string{"", "a/b"} {
+		if err := i.RenameChart("foo", name); err == nil {
+			t.Errorf("Expected an error for the chart name %q", name)
+		}
+	}
+	if err := i.RenameChart("missing", "other"); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		strategy MergeStrategy
+		digest   string
+	}{
+		{MergeKeepExisting, "bar"},
+		{MergeOverwrite, "foo"},
+	} {
+		i = newIndex(t)
+		if err := i.RenameChartWithOptions("foo", "bar", RenameOptions{Merge: true, Strategy: tc.strategy}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(i.Entries["bar"]) != 3 {
+			t.Errorf("Expected 3 merged bar versions, got %d", len(i.Entries["bar"]))
+		}
+		cv, err := i.Get("bar", "0.2.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cv.Digest != tc.digest || cv.Name != "bar" {
+			t.Errorf("Expected bar 0.2.0 from %s, got %s named %s", tc.digest, cv.Digest, cv.Name)
+		}
+	}
+}
+
+func TestGetByDigest(t *testing.T) {
+	i := NewIndexFile()
+	for _, x := range []struct {
+		md     *chart.Metadata
+		digest string
+	}{
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0"}, "sha256:AAAA"},
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0"}, "bbbb"},
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.3.0"}, ""},
+	} {
+		if err := i.MustAdd(x.md, x.md.Name+"-"+x.md.Version+".tgz", "http://example.com/charts", x.digest); err != nil {
+			t.Fatalf("unexpected error adding to index: %s", err)
+		}
+	}
+
+	for digest, version := range map[string]string{
+		"aaaa":        "0.1.0",
+		"sha256:aaaa": "0.1.0",
+		"sha256:BBBB": "0.2.0",
+	} {
+		cv, err := i.GetByDigest("cutter", digest)
+		if err != nil {
+			t.Errorf("unexpected error for digest %q: %s", digest, err)
+			continue
+		}
+		if cv.Version != version {
+			t.Errorf("Expected version %s for digest %q, got %s", version, digest, cv.Version)
+		}
+	}
+
+	if _, err := i.GetByDigest("cutter", "cccc"); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion, got %v", err)
+	}
+	if _, err := i.GetByDigest("cutter", ""); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion for an empty digest, got %v", err)
+	}
+	if _, err := i.GetByDigest("setter", "aaaa"); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+}
+
+func TestSubset(t *testing.T) {
+	i, err := LoadIndexFile(annotationstestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := i.Subset("nginx", "missing")
+	if len(sub.Entries) != 1 {
+		t.Fatalf("Expected 1 chart, got %d", len(sub.Entries))
+	}
+	if len(sub.Entries["nginx"]) != 2 {
+		t.Errorf("Expected 2 nginx versions, got %d", len(sub.Entries["nginx"]))
+	}
+	if sub.APIVersion != i.APIVersion || !sub.Generated.Equal(i.Generated) {
+		t.Error("Expected top-level fields to be copied")
+	}
+	if sub.Annotations["helm.sh/test"] != "foo bar" {
+		t.Error("Expected index annotations to be copied")
+	}
+
+	sub.Entries["nginx"] = sub.Entries["nginx"][:1]
+	sub.Annotations["helm.sh/test"] = "changed"
+	if len(i.Entries["nginx"]) != 2 || i.Annotations["helm.sh/test"] != "foo bar" {
+		t.Error("Expected the source index to be left untouched")
+	}
+	if len(i.Entries) != 3 {
+		t.Errorf("Expected the source index to keep 3 charts, got %d", len(i.Entries))
+	}
+}
+
+func TestConsistencyCheck(t *testing.T) {
+	i := NewIndexFile()
+	for _, x := range []struct {
+		md      *chart.Metadata
+		baseURL string
+		digest  string
+	}{
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0"}, "http://example.com/charts", "sha256:aaaa"},
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0"}, "http://mirror.example.com/charts", "AAAA"},
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0"}, "http://example.com/charts", "sha256:bbbb"},
+		{&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0"}, "http://mirror.example.com/charts", "sha256:cccc"},
+		{&chart.Metadata{APIVersion: "v2", Name: "setter", Version: "0.1.0"}, "http://example.com/charts", "sha256:dddd"},
+	} {
+		if err := i.MustAdd(x.md, x.md.Name+"-"+x.md.Version+".tgz", x.baseURL, x.digest); err != nil {
+			t.Fatalf("unexpected error adding to index: %s", err)
+		}
+	}
+
+	report := i.ConsistencyCheck()
+	if len(report) != 1 {
+		t.Fatalf("Expected 1 inconsistent entry, got %v", report)
+	}
+	entry := report[0]
+	if entry.Name != "cutter" || entry.Version != "0.2.0" {
+		t.Errorf("Expected cutter 0.2.0 to be reported, got %s %s", entry.Name, entry.Version)
+	}
+	if strings.Join(entry.Digests, " ") != "sha256:bbbb sha256:cccc" {
+		t.Errorf("Unexpected digests: %v", entry.Digests)
+	}
+	if len(entry.URLs) != 2 {
+		t.Errorf("Expected 2 URLs, got %v", entry.URLs)
+	}
+}
+
+func TestSetReplacement(t *testing.T) {
+	i, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := i.Entries["nginx"][0].ReplacedBy(); ok {
+		t.Error("Expected nginx to have no replacement")
+	}
+
+	if err := i.SetReplacement("nginx", "caddy"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cv := range i.Entries["nginx"] {
+		if r, ok := cv.ReplacedBy(); !ok || r != "caddy" {
+			t.Errorf("Expected nginx %s to be replaced by caddy, got %q", cv.Version, r)
+		}
+	}
+	if _, ok := i.Entries["alpine"][0].ReplacedBy(); ok {
+		t.Error("Expected alpine to have no replacement")
+	}
+
+	if err := i.SetReplacement("nginx", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.Entries["nginx"][0].ReplacedBy(); ok {
+		t.Error("Expected the replacement to be removed")
+	}
+
+	if err := i.SetReplacement("missing", "caddy"); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+}
+
+func TestFilterByKubeVersion(t *testing.T) {
+	i := NewIndexFile()
+	addCharts(t, i,
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.1.0", KubeVersion: ">=1.20.0-0"},
+		&chart.Metadata{APIVersion: "v2", Name: "cutter", Version: "0.2.0", KubeVersion: ">=1.28.0-0"},
+		&chart.Metadata{APIVersion: "v2", Name: "clipper", Version: "0.1.0"},
+		&chart.Metadata{APIVersion: "v2", Name: "setter", Version: "0.1.0", KubeVersion: "<1.16.0"},
+	)
+
+	filtered, err := i.FilterByKubeVersion("v1.25.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered.Entries) != 2 {
+		t.Fatalf("Expected 2 charts, got %d", len(filtered.Entries))
+	}
+	if cvs := filtered.Entries["cutter"]; len(cvs) != 1 || cvs[0].Version != "0.1.0" {
+		t.Errorf("Expected only cutter 0.1.0, got %v", cvs)
+	}
+	if _, ok := filtered.Entries["clipper"]; !ok {
+		t.Error("Expected clipper without a KubeVersion to be kept")
+	}
+	if _, ok := filtered.Entries["setter"]; ok {
+		t.Error("Expected setter to be dropped")
+	}
+
+	if _, err := i.FilterByKubeVersion("not-a-version"); err == nil {
+		t.Error("Expected an error for an invalid Kubernetes version")
+	}
+}
+
+func TestExpireOlderThan(t *testing.T) {
+	now := time.Now()
+	i := NewIndexFile()
+	for _, x := range []struct {
+		name, version string
+		created       time.Time
+	}{
+		{"cutter", "0.1.0", now.Add(-72 * time.Hour)},
+		{"cutter", "0.2.0", now.Add(-time.Hour)},
+		{"cutter", "0.3.0", time.Time{}},
+		{"setter", "0.1.0", now.Add(-48 * time.Hour)},
+	} {
+		i.Entries[x.name] = append(i.Entries[x.name], &ChartVersion{
+			Metadata: &chart.Metadata{Name: x.name, Version: x.version},
+			Created:  x.created,
+		})
+	}
+
+	if removed := i.ExpireOlderThan(24 * time.Hour); removed != 2 {
+		t.Errorf("Expected 2 versions removed, got %d", removed)
+	}
+	if _, ok := i.Entries["setter"]; ok {
+		t.Error("Expected setter to be removed")
+	}
+	cvs := i.Entries["cutter"]
+	if len(cvs) != 2 || cvs[0].Version != "0.3.0" || cvs[1].Version != "0.2.0" {
+		t.Errorf("Expected cutter 0.3.0 and 0.2.0 to remain, got %v", cvs)
+	}
+}
+
+func TestRecommended(t *testing.T) {
+	i, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := i.Recommended("nginx"); ok {
+		t.Error("Expected no recommended nginx version")
+	}
+	if err := i.SetRecommended("nginx", "0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := i.Recommended("nginx"); !ok || v != "0.1.0" {
+		t.Errorf("Expected recommended nginx version 0.1.0, got %q", v)
+	}
+	if i.Annotations["recommended/nginx"] != "0.1.0" {
+		t.Error("Expected the recommendation to be stored in the index annotations")
+	}
+
+	if err := i.SetRecommended("nginx", "9.9.9"); err == nil {
+		t.Error("Expected an error recommending a missing version")
+	}
+	if err := i.SetRecommended("missing", "0.1.0"); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	var indices []*IndexFile
+	for n := 0; n < 5; n++ {
+		idx := NewIndexFile()
+		for _, v := range []string{"0.1.0", fmt.Sprintf("0.%d.0", n+2)} {
+			md := &chart.Metadata{APIVersion: "v2", Name: "dreadnought", Version: v}
+			if err := idx.MustAdd(md, "dreadnought-"+v+".tgz", "http://example.com", fmt.Sprintf("digest-%d", n)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		indices = append(indices, idx)
+	}
+
+	digests := func(i *IndexFile) map[string]string {
+		d := map[string]string{}
+		for _, cv := range i.Entries["dreadnought"] {
+			d[cv.Version] = cv.Digest
+		}
+		return d
+	}
+
+	t.Run("keep existing matches sequential merge", func(t *testing.T) {
+		merged, err := MergeAll(context.Background(), indices, MergeKeepExisting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sequential := indices[0].shallowCopy()
+		for _, idx := range indices[1:] {
+			sequential.Merge(idx)
+		}
+		got, expect := digests(merged), digests(sequential)
+		if len(got) != 6 || fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Errorf("Expected %v, got %v", expect, got)
+		}
+		if len(indices[0].Entries["dreadnought"]) != 2 {
+			t.Error("Expected the input indices to be left untouched")
+		}
+		for _, cv := range merged.Entries["dreadnought"] {
+			cv.Digest = "changed"
+		}
+		for _, idx := range indices {
+			for _, cv := range idx.Entries["dreadnought"] {
+				if cv.Digest == "changed" {
+					t.Fatal("Expected the merged index to share no chart versions with its inputs")
+				}
+			}
+		}
+	})
+
+	t.Run("overwrite keeps the last entry", func(t *testing.T) {
+		merged, err := MergeAll(context.Background(), indices, MergeOverwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := digests(merged)["0.1.0"]; got != "digest-4" {
+			t.Errorf("Expected 0.1.0 from the last index, got %s", got)
+		}
+		if l := len(merged.Entries["dreadnought"]); l != 6 {
+			t.Errorf("Expected 6 versions, got %d", l)
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := MergeAll(ctx, indices, MergeKeepExisting); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestRoundTripStable(t *testing.T) {
+	for _, f := range []string{testfile, annotationstestfile, chartmuseumtestfile, unorderedTestfile, jsonTestfile} {
+		stable, err := RoundTripStable(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stable {
+			t.Errorf("Expected %s to be round-trip stable", f)
+		}
+	}
+}
+
+func TestIndexEqual(t *testing.T) {
+	a, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SortEntriesBy(SortSemverAsc)
+
+	if eq, err := IndexEqual(a, b); err != nil || !eq {
+		t.Errorf("Expected indices differing only in order to be equal (%v)", err)
+	}
+
+	b.Entries["nginx"][0].Digest = "sha256:0000"
+	if eq, err := IndexEqual(a, b); err != nil || eq {
+		t.Errorf("Expected indices with different digests to differ (%v)", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadIndexFile(unorderedTestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SortEntriesBy(SortSemverAsc)
+	b.Generated = time.Now()
+	for _, cv := range b.Entries["nginx"] {
+		cv.Created = time.Now()
+	}
+
+	ha, hb := a.ContentHash(), b.ContentHash()
+	if ha != hb {
+		t.Errorf("Expected equal hashes, got %s and %s", ha, hb)
+	}
+
+	b.Entries["nginx"][0].Digest = "sha256:0000"
+	if hb = b.ContentHash(); ha == hb {
+		t.Error("Expected hashes to differ after changing a digest")
+	}
+
+	b.Entries["nginx"][0].Extra = map[string]interface{}{"unmarshalable": make(chan int)}
+	if hc := b.ContentHash(); hc == hb || hc != b.ContentHash() {
+		t.Error("Expected unmarshalable extra data to change the hash deterministically")
+	}
+}
+
+func TestMergeLimits(t *testing.T) {
+	newOther := func() *IndexFile {
+		i := NewIndexFile()
+		addCharts(t, i,
+			&chart.Metadata{APIVersion: "v2", Name: "bomb", Version: "0.1.0"},
+			&chart.Metadata{APIVersion: "v2", Name: "bomb", Version: "0.2.0"},
+			&chart.Metadata{APIVersion: "v2", Name: "bomb", Version: "0.3.0"},
+			&chart.Metadata{APIVersion: "v2", Name: "doughnut", Version: "0.1.0"},
+			&chart.Metadata{APIVersion: "v2", Name: "doughnut", Version: "0.2.0"},
+		)
+		return i
+	}
+
+	for _, tc := range []struct {
+		name   string
+		opts   MergeOptions
+		counts map[string]int
+		capped []string
+	}{
+		{"no limits", MergeOptions{}, map[string]int{"bomb": 3, "doughnut": 2}, nil},
+		{"per chart", MergeOptions{MaxEntriesPerChart: 2}, map[string]int{"bomb": 2, "doughnut": 2}, []string{"bomb"}},
+		{"total", MergeOptions{MaxTotalEntries: 3}, map[string]int{"bomb": 3}, []string{"doughnut"}},
+		{"both", MergeOptions{MaxEntriesPerChart: 1, MaxTotalEntries: 3}, map[string]int{"bomb": 1, "doughnut": 1}, []string{"bomb", "doughnut"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := NewIndexFile()
+			result := i.MergeWithOptions(newOther(), tc.opts)
+			if len(i.Entries) != len(tc.counts) {
+				t.Errorf("Expected %d charts, got %d", len(tc.counts), len(i.Entries))
+			}
+			for name, count := range tc.counts {
+				if l := len(i.Entries[name]); l != count {
+					t.Errorf("Expected %d %s versions, got %d", count, name, l)
+				}
+			}
+			if fmt.Sprint(result.Capped) != fmt.Sprint(tc.capped) {
+				t.Errorf("Expected capped charts %v, got %v", tc.capped, result.Capped)
+			}
+		})
+	}
+}
+
+func TestFilterByPlatform(t *testing.T) {
+	i := NewIndexFile()
+	addCharts(t, i,
+		&chart.Metadata{APIVersion: "v2", Name: "agent", Version: "0.1.0", Annotations: map[string]string{AnnotationOS: "linux", AnnotationArch: "amd64,arm64"}},
+		&chart.Metadata{APIVersion: "v2", Name: "agent", Version: "0.1.1", Annotations: map[string]string{AnnotationOS: "windows", AnnotationArch: "amd64"}},
+		&chart.Metadata{APIVersion: "v2", Name: "agent", Version: "0.1.2", Annotations: map[string]string{AnnotationOS: "Linux"}},
+		&chart.Metadata{APIVersion: "v2", Name: "universal", Version: "0.1.0"},
+		&chart.Metadata{APIVersion: "v2", Name: "winonly", Version: "0.1.0", Annotations: map[string]string{AnnotationOS: "windows"}},
+	)
+
+	filtered := i.FilterByPlatform("linux", "arm64")
+	if len(filtered.Entries) != 2 {
+		t.Fatalf("Expected 2 charts, got %d", len(filtered.Entries))
+	}
+	var got []string
+	for _, cv := range filtered.Entries["agent"] {
+		got = append(got, cv.Version)
+	}
+	if strings.Join(got, " ") != "0.1.0 0.1.2" {
+		t.Errorf("Expected agent 0.1.0 and 0.1.2, got %v", got)
+	}
+	if _, ok := filtered.Entries["universal"]; !ok {
+		t.Error("Expected the chart without platform annotations to be kept")
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["good-chart"] = ChartVersions{}
+	i.Entries["Bad_Chart"] = ChartVersions{}
+	i.Entries["9lives"] = ChartVersions{}
+
+	invalid, err := i.ValidateNames(`^[a-z][a-z0-9-]*$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Join(invalid, " ") != "9lives Bad_Chart" {
+		t.Errorf("Expected 9lives and Bad_Chart to be invalid, got %v", invalid)
+	}
+
+	if _, err := i.ValidateNames("[a-z"); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestCanonicalizeURLs(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["clipper"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "clipper", Version: "0.1.0"}, URLs: []string{
+			"HTTPS://Charts.Example.com:443//clipper/./clipper-0.1.0.tgz",
+			"http://mirror.example.com:80/clipper-0.1.0.tgz",
+			"http://mirror.example.com:8080/clipper-0.1.0.tgz",
+		}},
+		{Metadata: &chart.Metadata{Name: "clipper", Version: "0.0.1"}, URLs: []string{
+			"https://charts.example.com/clipper-0.0.1.tgz",
+			"charts//clipper-0.0.1.tgz",
+		}},
+	}
+
+	if changed := i.CanonicalizeURLs(); changed != 3 {
+		t.Errorf("Expected 3 URLs to change, got %d", changed)
+	}
+	expected := [][]string{
+		{
+			"https://charts.example.com/clipper/clipper-0.1.0.tgz",
+			"http://mirror.example.com/clipper-0.1.0.tgz",
+			"http://mirror.example.com:8080/clipper-0.1.0.tgz",
+		},
+		{
+			"https://charts.example.com/clipper-0.0.1.tgz",
+			"charts/clipper-0.0.1.tgz",
+		},
+	}
+	for idx, cv := range i.Entries["clipper"] {
+		if strings.Join(cv.URLs, " ") != strings.Join(expected[idx], " ") {
+			t.Errorf("Expected URLs %v, got %v", expected[idx], cv.URLs)
+		}
+	}
+	i.Entries["clipper"] = append(i.Entries["clipper"], nil, &ChartVersion{})
+	if changed := i.CanonicalizeURLs(); changed != 0 {
+		t.Errorf("Expected canonical URLs to be left alone, got %d changes", changed)
+	}
+}
+
+func TestPruneByMajor(t *testing.T) {
+	i := indexOfVersions(map[string][]string{
+		"majors": {"3.1.0", "1.0.0", "3.0.0", "2.5.0", "nightly", "2.0.0", "1.9.0", "4.0.0-beta.1"},
+		"single": {"1.0.0", "1.1.0"},
+	})
+
+	if removed := i.PruneByMajor(0); removed != 0 {
+		t.Errorf("Expected nothing to be removed with no limit, got %d", removed)
+	}
+	if removed := i.PruneByMajor(2); removed != 4 {
+		t.Errorf("Expected 4 versions to be removed, got %d", removed)
+	}
+	var got []string
+	for _, cv := range i.Entries["majors"] {
+		got = append(got, cv.Version)
+	}
+	if expect := "4.0.0-beta.1,3.1.0,3.0.0,nightly"; strings.Join(got, ",") != expect {
+		t.Errorf("Expected %s, got %s", expect, strings.Join(got, ","))
+	}
+	if l := len(i.Entries["single"]); l != 2 {
+		t.Errorf("Expected both versions of single to be kept, got %d", l)
+	}
+}
+
+func TestPrunePerChart(t *testing.T) {
+	i := indexOfVersions(map[string][]string{
+		"core":    {"1.0.0", "1.1.0", "1.2.0", "2.0.0"},
+		"scratch": {"0.1.0", "0.3.0", "0.2.0", "nightly"},
+		"other":   {"1.0.0", "1.0.1", "1.0.2"},
+	})
+
+	removed := i.PrunePerChart(map[string]int{"core": 0, "scratch": 1}, 2)
+	if removed != 3 {
+		t.Errorf("Expected 3 versions removed, got %d", removed)
+	}
+	for name, expect := range map[string]string{
+		"core":    "2.0.0 1.2.0 1.1.0 1.0.0",
+		"scratch": "0.3.0 nightly",
+		"other":   "1.0.2 1.0.1",
+	} {
+		var got []string
+		for _, cv := range i.Entries[name] {
+			got = append(got, cv.Version)
+		}
+		if strings.Join(got, " ") != expect {
+			t.Errorf("Expected %s versions %q, got %q", name, expect, strings.Join(got, " "))
+		}
+	}
+}
+
+func TestIsSorted(t *testing.T) {
+	i := NewIndexFile()
+	for _, v := range []string{"0.1.0", "0.3.0", "nightly", "0.2.0", "edge"} {
+		i.Entries["sorter"] = append(i.Entries["sorter"], &ChartVersion{Metadata: &chart.Metadata{Name: "sorter", Version: v}})
+	}
+	if i.IsSorted() {
+		t.Error("Expected the index not to be sorted")
+	}
+	i.SortEntries()
+	if !i.IsSorted() {
+		t.Errorf("Expected the index to be sorted after SortEntries, got %v", i.Entries["sorter"])
+	}
+}
+
+func TestChartVersionResolveURL(t *testing.T) {
+	cv := &ChartVersion{
+		Metadata: &chart.Metadata{Name: "museum", Version: "1.0.0"},
+		URLs:     []string{"charts/museum-1.0.0.tgz"},
+	}
+	info := ServerInfo{Present: true, ContextPath: "/v1/helm"}
+
+	for _, tc := range []struct {
+		base   string
+		info   ServerInfo
+		expect string
+	}{
+		{"https://example.com/v1/helm", info, "https://example.com/v1/helm/charts/museum-1.0.0.tgz"},
+		{"https://example.com", info, "https://example.com/v1/helm/charts/museum-1.0.0.tgz"},
+		{"https://example.com/?token=x", ServerInfo{ContextPath: "v1/helm/"}, "https://example.com/v1/helm/charts/museum-1.0.0.tgz?token=x"},
+		{"https://example.com/charts", ServerInfo{}, "https://example.com/charts/charts/museum-1.0.0.tgz"},
+		{"https://proxy/prefix", info, "https://proxy/prefix/charts/museum-1.0.0.tgz"},
+		{"https://proxy/prefix/v1/helm/", info, "https://proxy/prefix/v1/helm/charts/museum-1.0.0.tgz"},
+	} {
+		got, err := cv.ResolveURL(tc.base, tc.info)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tc.base, err)
+			continue
+		}
+		if got != tc.expect {
+			t.Errorf("Expected %s, got %s", tc.expect, got)
+		}
+	}
+
+	cv.URLs = []string{"https://cdn.example.com/museum-1.0.0.tgz"}
+	if got, err := cv.ResolveURL("https://example.com", info); err != nil || got != cv.URLs[0] {
+		t.Errorf("Expected the absolute URL to be kept, got %s, %v", got, err)
+	}
+	cv.URLs = nil
+	if _, err := cv.ResolveURL("https://example.com", info); err == nil {
+		t.Error("Expected an error for a chart without URLs")
+	}
+}
+
+func TestArtifactHubInfo(t *testing.T) {
+	cv := &ChartVersion{Metadata: &chart.Metadata{Name: "hubbub", Version: "1.0.0", Annotations: map[string]string{
+		"artifacthub.io/license": "Apache-2.0",
+		"artifacthub.io/changes": `- Added a feature
+- kind: fixed
+  description: Fixed a bug
+  links:
+    - name: issue
+      url: https://example.com/issues/1
+`,
+		"artifacthub.io/signKey": `fingerprint: C874011F0AB405110D02105534365D9472D7468F
+url: https://example.com/pgp_keys.asc
+`,
+		"artifacthub.io/images": `- name: app
+  image: example.com/app:1.0.0
+- name: sidecar
+  image: example.com/sidecar:2.1.0
+`,
+	}}}
+
+	info := cv.ArtifactHubInfo()
+	if info.License != "Apache-2.0" {
+		t.Errorf("Expected license Apache-2.0, got %q", info.License)
+	}
+	if strings.Join(info.Changes, "|") != "Added a feature|Fixed a bug" {
+		t.Errorf("Unexpected changes %q", info.Changes)
+	}
+	if info.SignKey != "C874011F0AB405110D02105534365D9472D7468F" {
+		t.Errorf("Unexpected sign key %q", info.SignKey)
+	}
+	if strings.Join(info.ContainersImages, " ") != "example.com/app:1.0.0 example.com/sidecar:2.1.0" {
+		t.Errorf("Unexpected images %q", info.ContainersImages)
+	}
+
+	cv.Annotations["artifacthub.io/changes"] = "not: [a list"
+	cv.Annotations["artifacthub.io/images"] = "just a string"
+	info = cv.ArtifactHubInfo()
+	if info.Changes != nil || info.ContainersImages != nil {
+		t.Errorf("Expected malformed annotations to be skipped, got %v and %v", info.Changes, info.ContainersImages)
+	}
+	if info.License != "Apache-2.0" {
+		t.Error("Expected well-formed annotations to still be parsed")
+	}
+}
+
+func TestGetReservedVersions(t *testing.T) {
+	i := NewIndexFile()
+	for _, v := range []string{"1.0.0", "1.1.0", "2.0.0-rc.1"} {
+		if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "reserved", Version: v}, "reserved-"+v+".tgz", "http://example.com", "aaaa"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	i.SortEntries()
+
+	for _, version := range []string{VersionLatest, VersionStable} {
+		cv, err := i.Get("reserved", version)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", version, err)
+		}
+		if cv.Version != "1.1.0" {
+			t.Errorf("Expected %q to resolve to 1.1.0, got %s", version, cv.Version)
+		}
+	}
+
+	i.Entries["reserved"] = append(i.Entries["reserved"], &ChartVersion{Metadata: &chart.Metadata{Name: "reserved", Version: "latest"}})
+	if cv, err := i.Get("reserved", VersionLatest); err != nil || cv.Version != "latest" {
+		t.Errorf("Expected an exact match on the latest version, got %v, %v", cv, err)
+	}
+
+	var invalid ErrInvalidConstraint
+	if _, err := i.Get("reserved", "newest"); !errors.As(err, &invalid) {
+		t.Errorf("Expected ErrInvalidConstraint for an unknown keyword, got %v", err)
+	}
+}
+
+func TestGetInvalidConstraint(t *testing.T) {
+	i := NewIndexFile()
+	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "strict", Version: "1.0.0"}, "strict-1.0.0.tgz", "http://example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err := i.Get("strict", ">=1.0.0 <<2")
+	var invalid ErrInvalidConstraint
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Expected ErrInvalidConstraint, got %v", err)
+	}
+	if invalid.Constraint != ">=1.0.0 <<2" {
+		t.Errorf("Expected the constraint to be recorded, got %q", invalid.Constraint)
+	}
+	if !strings.Contains(err.Error(), invalid.Err.Error()) {
+		t.Errorf("Expected %q to contain the parse error %q", err, invalid.Err)
+	}
+
+	if _, err := i.Entries["strict"].Get("^2"); err != ErrNoChartVersion {
+		t.Errorf("Expected ErrNoChartVersion, got %v", err)
+	}
+	if _, err := i.Get("strict", "^2"); err == nil || errors.As(err, &invalid) {
+		t.Errorf("Expected a no chart version error, got %v", err)
+	}
+	if cv, err := i.Entries["strict"].Get(""); err != nil || cv.Version != "1.0.0" {
+		t.Errorf("Expected strict 1.0.0, got %v, %v", cv, err)
+	}
+}
+
+func TestYankedDependencies(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["lib"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "lib", Version: "1.2.0"}, Removed: true},
+		{Metadata: &chart.Metadata{Name: "lib", Version: "1.1.0"}},
+		{Metadata: &chart.Metadata{Name: "lib", Version: "1.0.0"}, Removed: true},
+	}
+	i.Entries["app"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "app", Version: "2.0.0", Dependencies: []*chart.Dependency{
+			{Name: "lib", Version: "^1.0.0"},
+			{Name: "external", Version: "1.0.0"},
+		}}},
+		{Metadata: &chart.Metadata{Name: "app", Version: "1.0.0", Dependencies: []*chart.Dependency{
+			{Name: "lib", Version: "1.0.0"},
+		}}},
+		{Metadata: &chart.Metadata{Name: "app", Version: "0.9.0", Dependencies: []*chart.Dependency{
+			{Name: "lib", Version: "~1.1.0"},
+		}}},
+	}
+	i.Entries["old"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "old", Version: "0.1.0", Dependencies: []*chart.Dependency{
+			{Name: "lib", Version: "1.0.0"},
+		}}, Removed: true},
+	}
+
+	yanked := i.YankedDependencies()
+	expected := []YankedRef{
+		{Chart: ChartRef{"app", "1.0.0"}, Dependency: ChartRef{"lib", "1.0.0"}},
+		{Chart: ChartRef{"app", "2.0.0"}, Dependency: ChartRef{"lib", "1.2.0"}},
+	}
+	if len(yanked) != len(expected) {
+		t.Fatalf("Expected %d yanked dependencies, got %v", len(expected), yanked)
+	}
+	for idx := range expected {
+		if yanked[idx] != expected[idx] {
+			t.Errorf("Expected %v, got %v", expected[idx], yanked[idx])
+		}
+	}
+}
+
+func TestHasChart(t *testing.T) {
+	i := NewIndexFile()
+	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "present", Version: "0.1.0"}, "present-0.1.0.tgz", "http://example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Entries["empty"] = ChartVersions{}
+
+	if !i.HasChart("present") {
+		t.Error("Expected present to be found")
+	}
+	for _, name := range []string{"empty", "absent"} {
+		if i.HasChart(name) {
+			t.Errorf("Expected %s not to be found", name)
+		}
+	}
+}
+
+func TestCanSatisfy(t *testing.T) {
+	i := NewIndexFile()
+	for _, v := range []string{"1.2.0", "2.0.0-rc.1"} {
+		if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "ui", Version: v}, "ui-"+v+".tgz", "http://example.com", "aaaa"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	for constraint, expect := range map[string]bool{
+		"":            true,
+		"^1.0.0":      true,
+		">=2.0.0-0":   true,
+		">=2.0.0":     false,
+		"not-a-range": false,
+	} {
+		if got := i.CanSatisfy("ui", constraint); got != expect {
+			t.Errorf("CanSatisfy(ui, %q): expected %t, got %t", constraint, expect, got)
+		}
+	}
+	if i.CanSatisfy("absent", "*") {
+		t.Error("Expected a missing chart not to be satisfiable")
+	}
+}
+
+func TestPrereleaseOnlyCharts(t *testing.T) {
+	i := indexOfVersions(map[string][]string{
+		"beta":     {"0.2.0-beta.1", "0.1.0-alpha.1"},
+		"mixed":    {"1.0.0", "1.1.0-rc.1"},
+		"sloppy":   {"latest", "0.1.0-rc.1"},
+		"unparsed": {"latest", "nightly"},
+	})
+
+	if got, expect := strings.Join(i.PrereleaseOnlyCharts(), ","), "beta,sloppy"; got != expect {
+		t.Errorf("Expected %s, got %s", expect, got)
+	}
+	got := strings.Join(i.PrereleaseOnlyChartsWithOptions(PrereleaseOptions{IncludeUnparseable: true}), ",")
+	if expect := "beta,sloppy,unparsed"; got != expect {
+		t.Errorf("Expected %s, got %s", expect, got)
+	}
+}
+
+func TestDeprecatedLatest(t *testing.T) {
+	i := NewIndexFile()
+	for name, versions := range map[string][]struct {
+		version    string
+		deprecated bool
+	}{
+		"eol":      {{"1.0.0", false}, {"2.0.0", true}},
+		"revived":  {{"1.0.0", true}, {"1.1.0", false}},
+		"obsolete": {{"0.1.0", true}, {"0.2.0", true}},
+		"unparsed": {{"latest", true}},
+	} {
+		for _, v := range versions {
+			i.Entries[name] = append(i.Entries[name], &ChartVersion{Metadata: &chart.Metadata{Name: name, Version: v.version, Deprecated: v.deprecated}})
+		}
+	}
+
+	if got, expect := strings.Join(i.DeprecatedLatest(), ","), "eol,obsolete"; got != expect {
+		t.Errorf("Expected %s, got %s", expect, got)
+	}
+}
+
+func TestValidateDigestFormats(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	i := NewIndexFile()
+	for _, x := range []struct{ version, digest string }{
+		{"1.0.0", sum},
+		{"1.0.1", "sha256:" + sum},
+		{"1.0.2", strings.ToUpper(sum)},
+		{"1.0.3", ""},
+		{"1.0.4", "sha512:" + sum},
+		{"1.0.5", "sha256:abcd"},
+		{"1.0.6", "not-a-digest"},
+	} {
+		i.Entries["digester"] = append(i.Entries["digester"], &ChartVersion{Metadata: &chart.Metadata{Name: "digester", Version: x.version}, Digest: x.digest})
+	}
+
+	report := i.ValidateDigestFormats()
+	var got []string
+	for _, issue := range report {
+		got = append(got, issue.Version)
+		if issue.Problem == "" {
+			t.Errorf("Expected a problem for %s", issue.Version)
+		}
+	}
+	if expect := "1.0.3 1.0.4 1.0.5 1.0.6"; strings.Join(got, " ") != expect {
+		t.Errorf("Expected issues for %q, got %q", expect, strings.Join(got, " "))
+	}
+	if !strings.Contains(report[1].Problem, "sha512") {
+		t.Errorf("Expected the unexpected algorithm to be named, got %q", report[1].Problem)
+	}
+}
+
+func TestSemverOptionsDistinguishBuildMetadata(t *testing.T) {
+	newIndex := func(t *testing.T, opts SemverOptions, versions ...string) *IndexFile {
+		t.Helper()
+		i := NewIndexFile()
+		i.SemverOptions = opts
+		for _, v := range versions {
+			if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "agent", Version: v}, "agent-"+v+".tgz", "http://example.com", "aaaa"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		return i
+	}
+
+	for _, tc := range []struct {
+		name   string
+		opts   SemverOptions
+		merged int
+	}{
+		{"default", SemverOptions{}, 1},
+		{"distinguish", SemverOptions{DistinguishBuildMetadata: true}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			i := newIndex(t, tc.opts, "1.0.0+linux")
+			i.Merge(newIndex(t, SemverOptions{}, "1.0.0+windows"))
+			if l := len(i.Entries["agent"]); l != tc.merged {
+				t.Errorf("Expected %d entries after merge, got %d", tc.merged, l)
+			}
+		})
+	}
+
+	i := newIndex(t, SemverOptions{DistinguishBuildMetadata: true}, "1.0.0+linux", "1.0.0+windows")
+	cv, err := i.Get("agent", "1.0.0+windows")
+	if err != nil || cv.Version != "1.0.0+windows" {
+		t.Errorf("Expected 1.0.0+windows, got %v, %v", cv, err)
+	}
+	if i.Has("agent", "1.0.0") {
+		t.Error("Expected 1.0.0 without build metadata not to be found")
+	}
+	if i.Has("agent", "1.0.0+darwin") {
+		t.Error("Expected 1.0.0+darwin not to be found")
+	}
+	if !i.Has("agent", "^1.0.0") {
+		t.Error("Expected ranges to ignore build metadata")
+	}
+}
+
+func TestToOCIReferences(t *testing.T) {
+	i := NewIndexFile()
+	for _, md := range []*chart.Metadata{
+		{APIVersion: "v2", Name: "zeta", Version: "1.0.0"},
+		{APIVersion: "v2", Name: "alpha", Version: "0.2.0+build.1"},
+		{APIVersion: "v2", Name: "alpha", Version: "0.1.0"},
+	} {
+		if err := i.MustAdd(md, md.Name+"-"+md.Version+".tgz", "http://example.com", "sha256:"+md.Name); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	for _, base := range []string{"registry.example.com/charts", "oci://registry.example.com/charts/"} {
+		refs := i.ToOCIReferences(base)
+		expected := []OCIReference{
+			{Name: "alpha", Version: "0.2.0+build.1", Reference: "oci://registry.example.com/charts/alpha:0.2.0_build.1", Digest: "sha256:alpha"},
+			{Name: "alpha", Version: "0.1.0", Reference: "oci://registry.example.com/charts/alpha:0.1.0", Digest: "sha256:alpha"},
+			{Name: "zeta", Version: "1.0.0", Reference: "oci://registry.example.com/charts/zeta:1.0.0", Digest: "sha256:zeta"},
+		}
+		if len(refs) != len(expected) {
+			t.Fatalf("Expected %d references, got %v", len(expected), refs)
+		}
+		for idx := range expected {
+			if refs[idx] != expected[idx] {
+				t.Errorf("Expected %v, got %v", expected[idx], refs[idx])
+			}
+		}
+	}
+}
+
+func TestTimestampAnomalies(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	i := NewIndexFile()
+	add := func(name, version string, created time.Time) {
+		i.Entries[name] = append(i.Entries[name], &ChartVersion{Metadata: &chart.Metadata{Name: name, Version: version}, Created: created})
+	}
+	add("steady", "0.1.0", base)
+	add("steady", "0.2.0", base.Add(time.Hour))
+	add("steady", "0.3.0", time.Time{})
+	add("backfilled", "1.0.0", base.Add(time.Hour))
+	add("backfilled", "1.1.0", base)
+	add("backfilled", "1.2.0", base.Add(2*time.Hour))
+	add("backfilled", "bogus", base.Add(-time.Hour))
+
+	report := i.TimestampAnomalies()
+	if len(report) != 1 {
+		t.Fatalf("Expected 1 anomaly, got %v", report)
+	}
+	expected := TimestampAnomaly{Name: "backfilled", Newer: "1.1.0", NewerCreated: base, Older: "1.0.0", OlderCreated: base.Add(time.Hour)}
+	if report[0] != expected {
+		t.Errorf("Expected %v, got %v", expected, report[0])
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["lib"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "lib", Version: "1.1.0"}},
+	}
+	i.Entries["app"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "app", Version: "1.0.0", Dependencies: []*chart.Dependency{
+			{Name: "lib", Version: "^1.0.0", Repository: "https://bundle.example.com"},
+			{Name: "lib", Version: "^2.0.0", Repository: "https://bundle.example.com"},
+			{Name: "db", Version: "1.0.0", Repository: "https://public.example.com"},
+			{Name: "vendored", Version: "1.0.0"},
+			{Name: "local", Version: "1.0.0", Repository: "file://../local"},
+		}}},
+	}
+
+	report := i.ValidateDependencies()
+	expected := []UnresolvedDep{
+		{Chart: ChartRef{"app", "1.0.0"}, Dependency: "db", Constraint: "1.0.0", Repository: "https://public.example.com"},
+		{Chart: ChartRef{"app", "1.0.0"}, Dependency: "lib", Constraint: "^2.0.0", Repository: "https://bundle.example.com"},
+	}
+	if len(report) != len(expected) {
+		t.Fatalf("Expected %d unresolved dependencies, got %v", len(expected), report)
+	}
+	for idx := range expected {
+		if report[idx] != expected[idx] {
+			t.Errorf("Expected %v, got %v", expected[idx], report[idx])
+		}
+	}
+
+	report = i.ValidateDependenciesWithOptions(DependencyValidationOptions{
+		SkipRepository: func(repository string) bool { return repository != "https://bundle.example.com" },
+	})
+	if len(report) != 1 || report[0].Dependency != "lib" {
+		t.Errorf("Expected only lib to be unresolved, got %v", report)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["web"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "web", Version: "1.0.0", Keywords: []string{"http", "Proxy"}}},
+		{Metadata: &chart.Metadata{Name: "web", Version: "2.0.0", Keywords: []string{"http", "ingress", "http", " "}}},
+	}
+	i.Entries["db"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "db", Version: "0.1.0", Keywords: []string{"sql", "proxy"}}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opts     KeywordOptions
+		expected map[string]int
+	}{
+		{"all", KeywordOptions{}, map[string]int{"http": 2, "Proxy": 1, "proxy": 1, "ingress": 1, "sql": 1}},
+		{"lowercase", KeywordOptions{Lowercase: true}, map[string]int{"http": 2, "proxy": 2, "ingress": 1, "sql": 1}},
+		{"latest", KeywordOptions{LatestOnly: true}, map[string]int{"http": 1, "ingress": 1, "sql": 1, "proxy": 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := i.KeywordsWithOptions(tc.opts)
+			if len(got) != len(tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+			for k, n := range tc.expected {
+				if got[k] != n {
+					t.Errorf("Expected %q to be counted %d times, got %d", k, n, got[k])
+				}
+			}
+		})
+	}
+
+	if got := i.Keywords(); got["http"] != 2 || got["Proxy"] != 1 {
+		t.Errorf("Unexpected keywords %v", got)
+	}
+}
+
+func TestDependencyClosure(t *testing.T) {
+	const repo = "https://charts.example.com"
+	i := NewIndexFile()
+	i.Entries["common"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "common", Version: "1.1.0"}},
+		{Metadata: &chart.Metadata{Name: "common", Version: "1.0.0"}},
+	}
+	i.Entries["db"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "db", Version: "2.0.0", Dependencies: []*chart.Dependency{
+			{Name: "common", Version: "^1.0.0", Repository: repo},
+		}}},
+	}
+	i.Entries["app"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "app", Version: "1.0.0", Dependencies: []*chart.Dependency{
+			{Name: "db", Version: "2.x", Repository: repo},
+			{Name: "common", Version: "1.1.0", Repository: repo},
+			{Name: "vendored", Version: "1.0.0"},
+		}}},
+		{Metadata: &chart.Metadata{Name: "app", Version: "0.9.0", Dependencies: []*chart.Dependency{
+			{Name: "cache", Version: "1.0.0", Repository: repo},
+			{Name: "db", Version: "^3.0.0", Repository: repo},
+		}}},
+	}
+	i.Entries["unrelated"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "unrelated", Version: "1.0.0"}},
+	}
+
+	closure, err := i.DependencyClosure("app", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, name := range []string{"app", "common", "db", "unrelated"} {
+		for _, cv := range closure.Entries[name] {
+			got = append(got, name+"-"+cv.Version)
+		}
+	}
+	expected := "app-1.0.0,common-1.1.0,db-2.0.0"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(got, ","))
+	}
+
+	_, err = i.DependencyClosure("app", "0.9.0")
+	if err == nil {
+		t.Fatal("Expected missing dependencies to be reported")
+	}
+	for _, name := range []string{"cache", "db"} {
+		if !strings.Contains(err.Error(), name+" ") {
+			t.Errorf("Expected %s to be listed as missing, got %s", name, err)
+		}
+	}
+
+	if _, err := i.DependencyClosure("absent", ""); err != ErrNoChartName {
+		t.Errorf("Expected ErrNoChartName, got %v", err)
+	}
+}
+
+func TestRecentlyUpdated(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2023, 3, d, 0, 0, 0, 0, time.UTC) }
+	i := NewIndexFile()
+	i.Entries["alpha"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "alpha", Version: "1.0.0"}, Created: day(20)},
+		{Metadata: &chart.Metadata{Name: "alpha", Version: "1.1.0"}, Created: day(5)},
+	}
+	i.Entries["bravo"] = ChartVersions{{Metadata: &chart.Metadata{Name: "bravo", Version: "0.1.0"}, Created: day(10)}}
+	i.Entries["charlie"] = ChartVersions{{Metadata: &chart.Metadata{Name: "charlie", Version: "0.2.0"}, Created: day(10)}}
+	i.Entries["delta"] = ChartVersions{{Metadata: &chart.Metadata{Name: "delta", Version: "3.0.0"}}}
+	i.Entries["echo"] = ChartVersions{{Metadata: &chart.Metadata{Name: "echo", Version: "nightly"}, Created: day(30)}}
+
+	var got []string
+	for _, ref := range i.RecentlyUpdated(0) {
+		got = append(got, ref.Name+"-"+ref.Version)
+	}
+	expected := "bravo-0.1.0,charlie-0.2.0,alpha-1.1.0,delta-3.0.0"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(got, ","))
+	}
+
+	if refs := i.RecentlyUpdated(2); len(refs) != 2 || refs[1].Name != "charlie" {
+		t.Errorf("Expected the two most recent charts, got %v", refs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	i := NewIndexFileWithOptions(WithClock(func() time.Time { return now }))
+	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "snap", Version: "1.0.0", Keywords: []string{"one"}, Annotations: map[string]string{"a": "b"}}, "snap-1.0.0.tgz", "http://example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Entries["snap"][0].Extra = map[string]interface{}{"nested": map[string]interface{}{"k": "v"}}
+	i.Annotations = map[string]string{"index": "yes"}
+
+	snap := i.Snapshot()
+	i.Entries["snap"][0].Version = "2.0.0"
+	i.Entries["snap"][0].Keywords[0] = "changed"
+	i.Entries["snap"][0].Annotations["a"] = "changed"
+	i.Entries["snap"][0].URLs[0] = "changed"
+	i.Entries["snap"][0].Extra["nested"].(map[string]interface{})["k"] = "changed"
+	i.Entries["other"] = ChartVersions{}
+	i.Annotations["index"] = "changed"
+
+	cv := snap.Entries["snap"][0]
+	if cv.Version != "1.0.0" || cv.Keywords[0] != "one" || cv.Annotations["a"] != "b" || cv.URLs[0] != "http://example.com/snap-1.0.0.tgz" {
+		t.Errorf("Expected the snapshot entry to be unchanged, got %+v", cv)
+	}
+	if cv.Extra["nested"].(map[string]interface{})["k"] != "v" {
+		t.Errorf("Expected nested extra fields to be copied, got %v", cv.Extra)
+	}
+	if _, ok := snap.Entries["other"]; ok || snap.Annotations["index"] != "yes" {
+		t.Error("Expected the snapshot index to be unchanged")
+	}
+	if !cv.Created.Equal(now) || !snap.currentTime().Equal(now) {
+		t.Errorf("Expected the snapshot to keep times and the clock, got %s and %s", cv.Created, snap.currentTime())
+	}
+}
+
+func TestDelta(t *testing.T) {
+	i := indexOfVersions(map[string][]string{
+		"alpha": {"1.0.0", "1.1.0", "1.2.0"},
+		"bravo": {"0.1.0"},
+	})
+	i.Annotations = map[string]string{"source": "delta"}
+
+	delta := i.Delta(map[string][]string{
+		"alpha":   {"1.0.0", "1.2.0"},
+		"bravo":   {"0.1.0"},
+		"charlie": {"9.9.9"},
+	})
+	if _, ok := delta.Entries["bravo"]; ok {
+		t.Error("Expected fully known charts to be left out")
+	}
+	if cvs := delta.Entries["alpha"]; len(cvs) != 1 || cvs[0].Version != "1.1.0" {
+		t.Errorf("Expected only alpha 1.1.0, got %v", cvs)
+	}
+
+	i.Entries["renamed"] = ChartVersions{{Metadata: &chart.Metadata{Name: "original", Version: "1.0.0"}}}
+	if _, ok := i.Delta(map[string][]string{"renamed": {"1.0.0"}}).Entries["renamed"]; ok {
+		t.Error("Expected entries to be matched by the name they are listed under")
+	}
+	delete(i.Entries, "renamed")
+	if delta.Annotations["source"] != "delta" || delta.APIVersion != i.APIVersion {
+		t.Error("Expected the top-level fields to be copied")
+	}
+
+	full := i.Delta(nil)
+	if len(full.Entries["alpha"]) != 3 || len(full.Entries["bravo"]) != 1 {
+		t.Errorf("Expected a full copy, got %v", full.Entries)
+	}
+	if full.Entries["alpha"][0].Version != "1.2.0" {
+		t.Errorf("Expected the copy to be sorted, got %s first", full.Entries["alpha"][0].Version)
+	}
+}
+
+func TestRegressedCharts(t *testing.T) {
+	baseline := indexOfVersions(map[string][]string{
+		"steady":    {"1.0.0", "1.1.0"},
+		"regressed": {"2.0.0", "1.0.0"},
+		"gone":      {"1.0.0"},
+	})
+	current := indexOfVersions(map[string][]string{
+		"steady":    {"1.2.0", "1.1.0"},
+		"regressed": {"1.0.0", "1.5.0", "not-a-version"},
+		"new":       {"0.1.0"},
+	})
+
+	regressed := current.RegressedCharts(baseline)
+	if len(regressed) != 1 || regressed[0] != (ChartRef{Name: "regressed", Version: "1.5.0"}) {
+		t.Errorf("Expected only regressed 1.5.0, got %v", regressed)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["complete"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "complete", Version: "1.0.0", Description: "A chart", Home: "https://example.com", Maintainers: []*chart.Maintainer{{Name: "helm"}}}},
+		{Metadata: &chart.Metadata{Name: "complete", Version: "0.1.0"}},
+	}
+	i.Entries["sparse"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "sparse", Version: "1.0.0", Description: "A chart", Maintainers: []*chart.Maintainer{}}},
+	}
+
+	required := []string{"Description", "home", "MAINTAINERS"}
+	report, err := i.Incomplete(required)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(report) != 1 || strings.Join(report["sparse"], " ") != "Home Maintainers" {
+		t.Errorf("Expected sparse to miss Home and Maintainers, got %v", report)
+	}
+
+	report, err = i.IncompleteWithOptions(required, IncompleteOptions{AllVersions: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Join(report["complete"], " ") != "Description Home Maintainers" {
+		t.Errorf("Expected the old complete version to be reported, got %v", report)
+	}
+
+	if _, err := i.Incomplete([]string{"Description", "Colour"}); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
+
+func TestValidateURLSchemes(t *testing.T) {
+	i := NewIndexFile()
+	i.Entries["schemer"] = ChartVersions{
+		{Metadata: &chart.Metadata{Name: "schemer", Version: "0.1.0"}, URLs: []string{
+			"https://example.com/schemer-0.1.0.tgz",
+			"HTTPS://mirror.example.com/schemer-0.1.0.tgz",
+			"oci://registry.example.com/charts/schemer:0.1.0",
+			"http://example.com/schemer-0.1.0.tgz",
+		}},
+		{Metadata: &chart.Metadata{Name: "schemer", Version: "0.2.0"}, URLs: []string{
+			"schemer-0.2.0.tgz",
+			"file:///srv/charts/schemer-0.2.0.tgz",
+			"https://example.com/%zz",
+		}},
+	}
+
+	report := i.ValidateURLSchemes([]string{"https", "oci"})
+	var got []string
+	for _, e := range report {
+		got = append(got, e.Version+" "+e.URL)
+	}
+	expected := []string{
+		"0.1.0 http://example.com/schemer-0.1.0.tgz",
+		"0.2.0 file:///srv/charts/schemer-0.2.0.tgz",
+		"0.2.0 https://example.com/%zz",
+		"0.2.0 schemer-0.2.0.tgz",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	report = i.ValidateURLSchemes([]string{"https", "oci", ""})
+	if len(report) != 3 {
+		t.Errorf("Expected relative URLs to be accepted, got %v", report)
+	}
+}
+
+func TestDownloadIndexFile(t *testing.T) {
+	t.Run("should  download index file", func(t *testing.T) {
+		srv, err := startLocalServerForTests(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		r, err := NewChartRepository(&Entry{
+			Name: testRepo,
+			URL:  srv.URL,
+		}, getter.All(&cli.EnvSettings{}))
+		if err != nil {
+			t.Errorf("Problem creating chart repository from %s: %v", testRepo, err)
+		}
+
+		idx, err := r.DownloadIndexFile()
+		if err != nil {
+			t.Fatalf("Failed to download index file to %s: %#v", idx, err)
+		}
+
+		if _, err := os.Stat(idx); err != nil {
+			t.Fatalf("error finding created index file: %#v", err)
+		}
+
+		i, err := LoadIndexFile(idx)
+		if err != nil {
+			t.Fatalf("Index %q failed to parse: %s", testfile, err)
+		}
+		verifyLocalIndex(t, i)
+
+		// Check that charts file is also created
+		idx = filepath.Join(r.CachePath, helmpath.CacheChartsFile(r.Config.Name))
+		if _, err := os.Stat(idx); err != nil {
+			t.Fatalf("error finding created charts file: %#v", err)
+		}
+
+		b, err := os.ReadFile(idx)
+		if err != nil {
+			t.Fatalf("error reading charts file: %#v", err)
+		}
+		verifyLocalChartsFile(t, b, i)
+	})
+
+	t.Run("should not decode the path in the repo url while downloading index", func(t *testing.T) {
+		chartRepoURLPath := "/some%2Fpath/test"
+		fileBytes, err := os.ReadFile("testdata/local-index.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.RawPath == chartRepoURLPath+"/index.yaml" {
+				w.Write(fileBytes)
+			}
+		})
+		srv, err := startLocalServerForTests(handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		r, err := NewChartRepository(&Entry{
+			Name: testRepo,
+			URL:  srv.URL + chartRepoURLPath,
+		}, getter.All(&cli.EnvSettings{}))
+		if err != nil {
+			t.Errorf("Problem creating chart repository from %s: %v", testRepo, err)
+		}
+
+		idx, err := r.DownloadIndexFile()
+		if err != nil {
+			t.Fatalf("Failed to download index file to %s: %#v", idx, err)
+		}
+
+		if _, err := os.Stat(idx); err != nil {
 			t.Fatalf("error finding created index file: %#v", err)
 		}
 
-		i, err := LoadIndexFile(idx)
-		if err != nil {
-			t.Fatalf("Index %q failed to parse: %s", testfile, err)
+		i, err := LoadIndexFile(idx)
+		if err != nil {
+			t.Fatalf("Index %q failed to parse: %s", testfile, err)
+		}
+		verifyLocalIndex(t, i)
+
+		// Check that charts file is also created
+		idx = filepath.Join(r.CachePath, helmpath.CacheChartsFile(r.Config.Name))
+		if _, err := os.Stat(idx); err != nil {
+			t.Fatalf("error finding created charts file: %#v", err)
+		}
+
+		b, err := os.ReadFile(idx)
+		if err != nil {
+			t.Fatalf("error reading charts file: %#v", err)
+		}
+		verifyLocalChartsFile(t, b, i)
+	})
+}
+
+func verifyLocalIndex(t *testing.T, i *IndexFile) {
+	numEntries := len(i.Entries)
+	if numEntries != 3 {
+		t.Errorf("Expected 3 entries in index file but got %d", numEntries)
+	}
+
+	alpine, ok := i.Entries["alpine"]
+	if !ok {
+		t.Fatalf("'alpine' section not found.")
+	}
+
+	if l := len(alpine); l != 1 {
+		t.Fatalf("'alpine' should have 1 chart, got %d", l)
+	}
+
+	nginx, ok := i.Entries["nginx"]
+	if !ok || len(nginx) != 2 {
+		t.Fatalf("Expected 2 nginx entries")
+	}
+
+	expects := []*ChartVersion{
+		{
+			Metadata: &chart.Metadata{
+				APIVersion:  "v2",
+				Name:        "alpine",
+				Description: "string",
+				Version:     "1.0.0",
+				Keywords:    []string{"linux", "alpine", "small", "sumtin"},
+				Home:        "https://github.com/something",
+			},
+			URLs: []string{
+				"https://charts.helm.sh/stable/alpine-1.0.0.tgz",
+				"http://storage2.googleapis.com/kubernetes-charts/alpine-1.0.0.tgz",
+			},
+			Digest: "sha256:1234567890abcdef",
+		},
+		{
+			Metadata: &chart.Metadata{
+				APIVersion:  "v2",
+				Name:        "nginx",
+				Description: "string",
+				Version:     "0.2.0",
+				Keywords:    []string{"popular", "web server", "proxy"},
+				Home:        "https://github.com/something/else",
+			},
+			URLs: []string{
+				"https://charts.helm.sh/stable/nginx-0.2.0.tgz",
+			},
+			Digest: "sha256:1234567890abcdef",
+		},
+		{
+			Metadata: &chart.Metadata{
+				APIVersion:  "v2",
+				Name:        "nginx",
+				Description: "string",
+				Version:     "0.1.0",
+				Keywords:    []string{"popular", "web server", "proxy"},
+				Home:        "https://github.com/something",
+			},
+			URLs: []string{
+				"https://charts.helm.sh/stable/nginx-0.1.0.tgz",
+			},
+			Digest: "sha256:1234567890abcdef",
+		},
+	}
+	tests := []*ChartVersion{alpine[0], nginx[0], nginx[1]}
+
+	for i, tt := range tests {
+		expect := expects[i]
+		if tt.Name != expect.Name {
+			t.Errorf("Expected name %q, got %q", expect.Name, tt.Name)
+		}
+		if tt.Description != expect.Description {
+			t.Errorf("Expected description %q, got %q", expect.Description, tt.Description)
+		}
+		if tt.Version != expect.Version {
+			t.Errorf("Expected version %q, got %q", expect.Version, tt.Version)
+		}
+		if tt.Digest != expect.Digest {
+			t.Errorf("Expected digest %q, got %q", expect.Digest, tt.Digest)
+		}
+		if tt.Home != expect.Home {
+			t.Errorf("Expected home %q, got %q", expect.Home, tt.Home)
+		}
+
+		for i, url := range tt.URLs {
+			if url != expect.URLs[i] {
+				t.Errorf("Expected URL %q, got %q", expect.URLs[i], url)
+			}
+		}
+		for i, kw := range tt.Keywords {
+			if kw != expect.Keywords[i] {
+				t.Errorf("Expected keywords %q, got %q", expect.Keywords[i], kw)
+			}
+		}
+	}
+}
+
+func verifyLocalChartsFile(t *testing.T, chartsContent []byte, indexContent *IndexFile) {
+	var expected, reald []string
+	for chart := range indexContent.Entries {
+		expected = append(expected, chart)
+	}
+	sort.Strings(expected)
+
+	scanner := bufio.NewScanner(bytes.NewReader(chartsContent))
+	for scanner.Scan() {
+		reald = append(reald, scanner.Text())
+	}
+	sort.Strings(reald)
+
+	if strings.Join(expected, " ") != strings.Join(reald, " ") {
+		t.Errorf("Cached charts file content unexpected. Expected:\n%s\ngot:\n%s", expected, reald)
+	}
+}
+
+func TestIndexDirectory(t *testing.T) {
+	dir := "testdata/repository"
+	index, err := IndexDirectory(dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(index.Entries); l != 3 {
+		t.Fatalf("Expected 3 entries, got %d", l)
+	}
+
+	// Other things test the entry generation more thoroughly. We just test a
+	// few fields.
+
+	corpus := []struct{ chartName, downloadLink string }{
+		{"frobnitz", "http://localhost:8080/frobnitz-1.2.3.tgz"},
+		{"zarthal", "http://localhost:8080/universe/zarthal-1.0.0.tgz"},
+	}
+
+	for _, test := range corpus {
+		cname := test.chartName
+		frobs, ok := index.Entries[cname]
+		if !ok {
+			t.Fatalf("Could not read chart %s", cname)
+		}
+
+		frob := frobs[0]
+		if frob.Digest == "" {
+			t.Errorf("Missing digest of file %s.", frob.Name)
+		}
+		if frob.URLs[0] != test.downloadLink {
+			t.Errorf("Unexpected URLs: %v", frob.URLs)
+		}
+		if frob.Name != cname {
+			t.Errorf("Expected %q, got %q", cname, frob.Name)
+		}
+	}
+}
+
+func TestIndexDirectoryRelativeURLs(t *testing.T) {
+	index, err := IndexDirectoryWithOptions("testdata/repository", "http://localhost:8080", IndexDirectoryOptions{RelativeURLs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ chartName, downloadLink string }{
+		{"frobnitz", "frobnitz-1.2.3.tgz"},
+		{"zarthal", "universe/zarthal-1.0.0.tgz"},
+	} {
+		cvs, ok := index.Entries[test.chartName]
+		if !ok {
+			t.Fatalf("Could not read chart %s", test.chartName)
 		}
-		verifyLocalIndex(t, i)
+		if cvs[0].URLs[0] != test.downloadLink {
+			t.Errorf("Expected URL %q, got %v", test.downloadLink, cvs[0].URLs)
+		}
+	}
+	for _, cvs := range index.Entries {
+		for _, cv := range cvs {
+			for _, u := range cv.URLs {
+				if strings.Contains(u, "://") || strings.Contains(u, "localhost") {
+					t.Errorf("Expected a relative URL, got %q", u)
+				}
+			}
+		}
+	}
+}
 
-		// Check that charts file is also created
-		idx = filepath.Join(r.CachePath, helmpath.CacheChartsFile(r.Config.Name))
-		if _, err := os.Stat(idx); err != nil {
-			t.Fatalf("error finding created charts file: %#v", err)
+func TestWriteFileWithGenerated(t *testing.T) {
+	generated := time.Unix(1700000000, 0).UTC()
+	opts := IndexDirectoryOptions{Generated: generated}
+
+	var written [][]byte
+	for n := 0; n < 2; n++ {
+		index, err := IndexDirectoryWithOptions("testdata/repository", "http://localhost:8080", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.SortEntries()
+		for _, cvs := range index.Entries {
+			for _, cv := range cvs {
+				if !cv.Created.Equal(generated) {
+					t.Errorf("Expected %s to be created at %s, got %s", cv.Name, generated, cv.Created)
+				}
+			}
 		}
+		// Move the Generated time away to check that the written one is pinned.
+		index.Generated = time.Now()
 
-		b, err := os.ReadFile(idx)
+		dest := filepath.Join(t.TempDir(), "index.yaml")
+		if err := index.WriteFileWithGenerated(dest, 0644, generated); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(dest)
 		if err != nil {
-			t.Fatalf("error reading charts file: %#v", err)
+			t.Fatal(err)
 		}
-		verifyLocalChartsFile(t, b, i)
-	})
+		written = append(written, b)
 
-	t.Run("should not decode the path in the repo url while downloading index", func(t *testing.T) {
-		chartRepoURLPath := "/some%2Fpath/test"
-		fileBytes, err := os.ReadFile("testdata/local-index.yaml")
+		loaded, err := LoadIndexFile(dest)
 		if err != nil {
 			t.Fatal(err)
 		}
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.RawPath == chartRepoURLPath+"/index.yaml" {
-				w.Write(fileBytes)
+		if !loaded.Generated.Equal(generated) {
+			t.Errorf("Expected generated time %s, got %s", generated, loaded.Generated)
+		}
+	}
+	if !bytes.Equal(written[0], written[1]) {
+		t.Error("Expected indexing the same directory twice to write identical files")
+	}
+}
+
+func TestIndexDirectoryURLTemplate(t *testing.T) {
+	opts := IndexDirectoryOptions{URLTemplate: "https://cdn.example.com/{name}/{version}/{filename}"}
+	index, err := IndexDirectoryWithOptions("testdata/repository", "http://localhost:8080", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ chartName, downloadLink string }{
+		{"frobnitz", "https://cdn.example.com/frobnitz/1.2.3/frobnitz-1.2.3.tgz"},
+		{"zarthal", "https://cdn.example.com/zarthal/1.0.0/zarthal-1.0.0.tgz"},
+	} {
+		cvs, ok := index.Entries[test.chartName]
+		if !ok {
+			t.Fatalf("Could not read chart %s", test.chartName)
+		}
+		if len(cvs[0].URLs) != 1 || cvs[0].URLs[0] != test.downloadLink {
+			t.Errorf("Expected URL %q, got %v", test.downloadLink, cvs[0].URLs)
+		}
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	fixed := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return fixed }
+
+	i := NewIndexFileWithOptions(WithClock(clock))
+	if !i.Generated.Equal(fixed) {
+		t.Errorf("Expected generated time %s, got %s", fixed, i.Generated)
+	}
+	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "clockwork", Version: "0.1.0"}, "clockwork-0.1.0.tgz", "http://example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created := i.Entries["clockwork"][0].Created; !created.Equal(fixed) {
+		t.Errorf("Expected created time %s, got %s", fixed, created)
+	}
+
+	i.Entries["clockwork"][0].Created = fixed.Add(-2 * time.Hour)
+	if removed := i.ExpireOlderThan(time.Hour); removed != 1 {
+		t.Errorf("Expected the entry to expire by the index clock, got %d removed", removed)
+	}
+
+	index, err := IndexDirectoryWithOptions("testdata/repository", "http://localhost:8080", IndexDirectoryOptions{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Generated.Equal(fixed) {
+		t.Errorf("Expected generated time %s, got %s", fixed, index.Generated)
+	}
+	for _, cvs := range index.Entries {
+		for _, cv := range cvs {
+			if !cv.Created.Equal(fixed) {
+				t.Errorf("Expected %s to be created at %s, got %s", cv.Name, fixed, cv.Created)
 			}
-		})
-		srv, err := startLocalServerForTests(handler)
-		if err != nil {
+		}
+	}
+}
+
+// baselineIndexFile mirrors the index file of Helm releases that predate the
+// Size, Notes and Extra fields of ChartVersion. Those releases load indices
+// strictly, so an index they cannot unmarshal into it is one they reject.
+type baselineIndexFile struct {
+	ServerInfo  map[string]interface{}             `json:"serverInfo,omitempty"`
+	APIVersion  string                             `json:"apiVersion"`
+	Generated   time.Time                          `json:"generated"`
+	Entries     map[string][]*baselineChartVersion `json:"entries"`
+	PublicKeys  []string                           `json:"publicKeys,omitempty"`
+	Annotations map[string]string                  `json:"annotations,omitempty"`
+}
+
+type baselineChartVersion struct {
+	*chart.Metadata
+	URLs                    []string  `json:"urls"`
+	Created                 time.Time `json:"created,omitempty"`
+	Removed                 bool      `json:"removed,omitempty"`
+	Digest                  string    `json:"digest,omitempty"`
+	ChecksumDeprecated      string    `json:"checksum,omitempty"`
+	EngineDeprecated        string    `json:"engine,omitempty"`
+	TillerVersionDeprecated string    `json:"tillerVersion,omitempty"`
+	URLDeprecated           string    `json:"url,omitempty"`
+}
+
+// loadBaselineIndex unmarshals data the way older Helm releases do.
+func loadBaselineIndex(data []byte) error {
+	var i baselineIndexFile
+	return yaml.UnmarshalStrict(data, &i)
+}
+
+func TestIndexDirectoryBaselineCompatible(t *testing.T) {
+	index, err := IndexDirectory("testdata/repository", "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("size:")) {
+		t.Error("Expected no sizes to be recorded by default")
+	}
+	if err := loadBaselineIndex(b); err != nil {
+		t.Errorf("Expected older clients to load the index: %s", err)
+	}
+}
+
+func TestIndexSizes(t *testing.T) {
+	dir := "testdata/repository"
+	index, err := IndexDirectoryWithOptions(dir, "http://localhost:8080", IndexDirectoryOptions{RecordSize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "frobnitz-1.2.3.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := index.Entries["frobnitz"][0].Size; size != fi.Size() {
+		t.Errorf("Expected frobnitz size %d, got %d", fi.Size(), size)
+	}
+
+	var expected int64
+	sizes := index.ChartSizes()
+	for name, cvs := range index.Entries {
+		var chartSize int64
+		for _, cv := range cvs {
+			if cv.Size == 0 {
+				t.Errorf("Expected a size for %s %s", name, cv.Version)
+			}
+			chartSize += cv.Size
+		}
+		if sizes[name] != chartSize {
+			t.Errorf("Expected %s size %d, got %d", name, chartSize, sizes[name])
+		}
+		expected += chartSize
+	}
+	if total := index.TotalSize(); total != expected {
+		t.Errorf("Expected total size %d, got %d", expected, total)
+	}
+
+	// Indices without sizes still load.
+	i, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := i.TotalSize(); total != 0 {
+		t.Errorf("Expected a total size of 0 without sizes, got %d", total)
+	}
+}
+
+func TestIndexDirectoryReleaseNotes(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []*chart.Chart{
+		{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "annotated", Version: "1.0.0", Annotations: map[string]string{AnnotationReleaseNotes: "Fixed everything."}},
+			Files:    []*chart.File{{Name: "NOTES", Data: []byte("Ignored in favor of the annotation.")}},
+		},
+		{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "noted", Version: "1.0.0"},
+			Files:    []*chart.File{{Name: "NOTES.md", Data: []byte("# 1.0.0\n\nFirst release.\n")}},
+		},
+		{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "silent", Version: "1.0.0"},
+		},
+	} {
+		if _, err := chartutil.Save(c, dir); err != nil {
 			t.Fatal(err)
 		}
-		defer srv.Close()
+	}
 
-		r, err := NewChartRepository(&Entry{
-			Name: testRepo,
-			URL:  srv.URL + chartRepoURLPath,
-		}, getter.All(&cli.EnvSettings{}))
-		if err != nil {
-			t.Errorf("Problem creating chart repository from %s: %v", testRepo, err)
+	index, err := IndexDirectory(dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cvs := range index.Entries {
+		if cvs[0].Notes != "" {
+			t.Errorf("Expected no release notes to be recorded for %s by default", name)
 		}
+	}
+	if err := loadBaselineIndex(b); err != nil {
+		t.Errorf("Expected older clients to load the index: %s", err)
+	}
 
-		idx, err := r.DownloadIndexFile()
+	index, err = IndexDirectoryWithOptions(dir, "http://localhost:8080", IndexDirectoryOptions{RecordNotes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexPath := filepath.Join(dir, "index.yaml")
+	if err := index.WriteFile(indexPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIndexFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expect := range map[string]string{
+		"annotated": "Fixed everything.",
+		"noted":     "# 1.0.0\n\nFirst release.\n",
+		"silent":    "",
+	} {
+		notes, err := loaded.ReleaseNotes(name, "1.0.0")
 		if err != nil {
-			t.Fatalf("Failed to download index file to %s: %#v", idx, err)
+			t.Errorf("Unexpected error for %s: %s", name, err)
+			continue
 		}
-
-		if _, err := os.Stat(idx); err != nil {
-			t.Fatalf("error finding created index file: %#v", err)
+		if notes != expect {
+			t.Errorf("Expected %s release notes %q, got %q", name, expect, notes)
 		}
+	}
+	if _, err := loaded.ReleaseNotes("noted", "2.0.0"); err == nil {
+		t.Error("Expected an error for a missing version")
+	}
+}
 
-		i, err := LoadIndexFile(idx)
+func TestIndexDirectorySymlinks(t *testing.T) {
+	dir := t.TempDir()
+	external := t.TempDir()
+	copyFile := func(src, dest string) {
+		t.Helper()
+		b, err := os.ReadFile(src)
 		if err != nil {
-			t.Fatalf("Index %q failed to parse: %s", testfile, err)
+			t.Fatal(err)
 		}
-		verifyLocalIndex(t, i)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dest, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyFile("testdata/repository/frobnitz-1.2.3.tgz", filepath.Join(dir, "charts", "frobnitz-1.2.3.tgz"))
+	copyFile("testdata/repository/sprocket-1.2.0.tgz", filepath.Join(external, "sprocket-1.2.0.tgz"))
+	if err := os.Symlink(filepath.Join(dir, "charts"), filepath.Join(dir, "mirror")); err != nil {
+		t.Skipf("symlinks not supported: %s", err)
+	}
+	if err := os.Symlink(external, filepath.Join(dir, "external")); err != nil {
+		t.Fatal(err)
+	}
 
-		// Check that charts file is also created
-		idx = filepath.Join(r.CachePath, helmpath.CacheChartsFile(r.Config.Name))
-		if _, err := os.Stat(idx); err != nil {
-			t.Fatalf("error finding created charts file: %#v", err)
+	tests := []struct {
+		name     string
+		opts     IndexDirectoryOptions
+		expected map[string]string
+	}{
+		{
+			name: "options default does not follow symlinks",
+			expected: map[string]string{
+				"frobnitz": "http://localhost:8080/charts/frobnitz-1.2.3.tgz",
+			},
+		},
+		{
+			name: "follow symlinks",
+			opts: IndexDirectoryOptions{FollowSymlinks: true},
+			expected: map[string]string{
+				"frobnitz": "http://localhost:8080/charts/frobnitz-1.2.3.tgz",
+				"sprocket": "http://localhost:8080/external/sprocket-1.2.0.tgz",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			index, err := IndexDirectoryWithOptions(dir, "http://localhost:8080", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l := len(index.Entries); l != len(tc.expected) {
+				t.Fatalf("Expected %d entries, got %d", len(tc.expected), l)
+			}
+			for name, link := range tc.expected {
+				cvs := index.Entries[name]
+				if len(cvs) != 1 {
+					t.Fatalf("Expected %s to be indexed once, got %d", name, len(cvs))
+				}
+				if cvs[0].URLs[0] != link {
+					t.Errorf("Expected %s, got %v", link, cvs[0].URLs)
+				}
+			}
+		})
+	}
+
+	index, err := IndexDirectory(dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Has("sprocket", "1.2.0") || len(index.Entries["frobnitz"]) != 1 {
+		t.Errorf("Expected IndexDirectory to follow symlinks without indexing charts twice, got %v", index.Entries)
+	}
+
+	root := filepath.Join(t.TempDir(), "linked-root")
+	if err := os.Symlink(dir, root); err != nil {
+		t.Fatal(err)
+	}
+	index, err = IndexDirectory(root, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, link := range map[string]string{
+		"frobnitz": "http://localhost:8080/charts/frobnitz-1.2.3.tgz",
+		"sprocket": "http://localhost:8080/external/sprocket-1.2.0.tgz",
+	} {
+		if cvs := index.Entries[name]; len(cvs) != 1 || cvs[0].URLs[0] != link {
+			t.Errorf("Expected %s to be indexed once at %s through a symlinked root, got %v", name, link, cvs)
 		}
+	}
+}
 
-		b, err := os.ReadFile(idx)
-		if err != nil {
-			t.Fatalf("error reading charts file: %#v", err)
+func TestRecomputeDigests(t *testing.T) {
+	dir := "testdata/repository"
+	index, err := IndexDirectory(dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := index.Entries["frobnitz"][0].Digest
+	index.Entries["frobnitz"][0].Digest = "sha256:0000"
+	if err := index.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "missing", Version: "0.1.0"}, "missing-0.1.0.tgz", "http://localhost:8080", "sha256:1111"); err != nil {
+		t.Fatalf("unexpected error adding to index: %s", err)
+	}
+
+	changed, err := index.RecomputeDigests(func(cv *ChartVersion) (string, error) {
+		if cv.Name == "missing" {
+			return "", fmt.Errorf("no archive for %s", cv.Name)
 		}
-		verifyLocalChartsFile(t, b, i)
+		_, file := filepath.Split(cv.URLs[0])
+		p := filepath.Join(dir, file)
+		if _, err := os.Stat(p); err != nil {
+			p = filepath.Join(dir, "universe", file)
+		}
+		return p, nil
 	})
+	if err == nil {
+		t.Error("Expected an error for the unresolvable entry")
+	}
+	if changed != 1 {
+		t.Errorf("Expected 1 changed digest, got %d", changed)
+	}
+	if got := index.Entries["frobnitz"][0].Digest; got != expected {
+		t.Errorf("Expected digest %s, got %s", expected, got)
+	}
+	if got := index.Entries["missing"][0].Digest; got != "sha256:1111" {
+		t.Errorf("Expected unresolved digest to be untouched, got %s", got)
+	}
+}
+
+func TestAppendDirectory(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.yaml")
+	copyFile := func(src, dest string) {
+		t.Helper()
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dest, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copyFile("testdata/repository/frobnitz-1.2.3.tgz", filepath.Join(dir, "frobnitz-1.2.3.tgz"))
+	if err := AppendDirectory(indexPath, dir, "http://localhost:8080", 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := LoadIndexFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(first.Entries))
+	}
+	created := first.Entries["frobnitz"][0].Created
+
+	copyFile("testdata/repository/sprocket-1.2.0.tgz", filepath.Join(dir, "sprocket-1.2.0.tgz"))
+	if err := AppendDirectory(indexPath, dir, "http://localhost:8080", 0644); err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadIndexFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(second.Entries))
+	}
+	if l := len(second.Entries["frobnitz"]); l != 1 {
+		t.Errorf("Expected frobnitz to be indexed once, got %d", l)
+	}
+	if !second.Entries["frobnitz"][0].Created.Equal(created) {
+		t.Errorf("Expected Created time %s to be kept, got %s", created, second.Entries["frobnitz"][0].Created)
+	}
 }
 
-func verifyLocalIndex(t *testing.T, i *IndexFile) {
-	numEntries := len(i.Entries)
-	if numEntries != 3 {
-		t.Errorf("Expected 3 entries in index file but got %d", numEntries)
+func TestLoadAndIndexDirectory(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.yaml")
+	b, err := os.ReadFile("testdata/repository/frobnitz-1.2.3.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "frobnitz-1.2.3.tgz"), b, 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	alpine, ok := i.Entries["alpine"]
-	if !ok {
-		t.Fatalf("'alpine' section not found.")
+	i, err := LoadAndIndexDirectory(indexPath, dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Has("frobnitz", "1.2.3") {
+		t.Error("Expected frobnitz-1.2.3 to be indexed")
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the index not to be written, got %v", err)
 	}
 
-	if l := len(alpine); l != 1 {
-		t.Fatalf("'alpine' should have 1 chart, got %d", l)
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	i.Entries["frobnitz"][0].Created = created
+	i.Entries["existing"] = ChartVersions{{Metadata: &chart.Metadata{Name: "existing", Version: "0.1.0"}}}
+	if err := i.WriteFile(indexPath, 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	nginx, ok := i.Entries["nginx"]
-	if !ok || len(nginx) != 2 {
-		t.Fatalf("Expected 2 nginx entries")
+	i, err = LoadAndIndexDirectory(indexPath, dir, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Has("existing", "0.1.0") {
+		t.Error("Expected the existing entry to be kept")
+	}
+	if l := len(i.Entries["frobnitz"]); l != 1 {
+		t.Fatalf("Expected frobnitz to be indexed once, got %d", l)
+	}
+	if got := i.Entries["frobnitz"][0].Created; !got.Equal(created) {
+		t.Errorf("Expected Created time %s to be kept, got %s", created, got)
 	}
+}
 
-	expects := []*ChartVersion{
-		{
-			Metadata: &chart.Metadata{
-				APIVersion:  "v2",
-				Name:        "alpine",
-				Description: "string",
-				Version:     "1.0.0",
-				Keywords:    []string{"linux", "alpine", "small", "sumtin"},
-				Home:        "https://github.com/something",
-			},
-			URLs: []string{
-				"https://charts.helm.sh/stable/alpine-1.0.0.tgz",
-				"http://storage2.googleapis.com/kubernetes-charts/alpine-1.0.0.tgz",
-			},
-			Digest: "sha256:1234567890abcdef",
-		},
-		{
-			Metadata: &chart.Metadata{
-				APIVersion:  "v2",
-				Name:        "nginx",
-				Description: "string",
-				Version:     "0.2.0",
-				Keywords:    []string{"popular", "web server", "proxy"},
-				Home:        "https://github.com/something/else",
-			},
-			URLs: []string{
-				"https://charts.helm.sh/stable/nginx-0.2.0.tgz",
-			},
-			Digest: "sha256:1234567890abcdef",
-		},
-		{
-			Metadata: &chart.Metadata{
-				APIVersion:  "v2",
-				Name:        "nginx",
-				Description: "string",
-				Version:     "0.1.0",
-				Keywords:    []string{"popular", "web server", "proxy"},
-				Home:        "https://github.com/something",
-			},
-			URLs: []string{
-				"https://charts.helm.sh/stable/nginx-0.1.0.tgz",
-			},
-			Digest: "sha256:1234567890abcdef",
-		},
+func TestChartVersionExtra(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.yaml")
+	b, err := os.ReadFile("testdata/repository/frobnitz-1.2.3.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "frobnitz-1.2.3.tgz"), b, 0644); err != nil {
+		t.Fatal(err)
 	}
-	tests := []*ChartVersion{alpine[0], nginx[0], nginx[1]}
 
-	for i, tt := range tests {
-		expect := expects[i]
-		if tt.Name != expect.Name {
-			t.Errorf("Expected name %q, got %q", expect.Name, tt.Name)
-		}
-		if tt.Description != expect.Description {
-			t.Errorf("Expected description %q, got %q", expect.Description, tt.Description)
-		}
-		if tt.Version != expect.Version {
-			t.Errorf("Expected version %q, got %q", expect.Version, tt.Version)
+	i := NewIndexFile()
+	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "frobnitz", Version: "1.2.3"}, "frobnitz-1.2.3.tgz", "http://localhost:8080", "sha256:stale"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Entries["frobnitz"][0].Extra = map[string]interface{}{
+		"buildID": "1234",
+		"vcs":     map[string]interface{}{"commit": "abcdef"},
+	}
+	if err := i.WriteFile(indexPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, write := range []func(*IndexFile) error{
+		func(i *IndexFile) error { return i.WriteFile(indexPath, 0644) },
+		func(i *IndexFile) error { return i.WriteJSONFile(indexPath, 0644) },
+		func(*IndexFile) error { return AppendDirectory(indexPath, dir, "http://localhost:8080", 0644) },
+	} {
+		loaded, err := LoadIndexFile(indexPath)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if tt.Digest != expect.Digest {
-			t.Errorf("Expected digest %q, got %q", expect.Digest, tt.Digest)
+		if err := write(loaded); err != nil {
+			t.Fatal(err)
 		}
-		if tt.Home != expect.Home {
-			t.Errorf("Expected home %q, got %q", expect.Home, tt.Home)
+		reloaded, err := LoadIndexFile(indexPath)
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		for i, url := range tt.URLs {
-			if url != expect.URLs[i] {
-				t.Errorf("Expected URL %q, got %q", expect.URLs[i], url)
-			}
+		extra := reloaded.Entries["frobnitz"][0].Extra
+		if extra["buildID"] != "1234" {
+			t.Errorf("Expected buildID to be preserved, got %v", extra)
 		}
-		for i, kw := range tt.Keywords {
-			if kw != expect.Keywords[i] {
-				t.Errorf("Expected keywords %q, got %q", expect.Keywords[i], kw)
-			}
+		if vcs, ok := extra["vcs"].(map[string]interface{}); !ok || vcs["commit"] != "abcdef" {
+			t.Errorf("Expected nested extra data to be preserved, got %v", extra)
 		}
 	}
-}
 
-func verifyLocalChartsFile(t *testing.T, chartsContent []byte, indexContent *IndexFile) {
-	var expected, reald []string
-	for chart := range indexContent.Entries {
-		expected = append(expected, chart)
+	regenerated, err := LoadIndexFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
 	}
-	sort.Strings(expected)
-
-	scanner := bufio.NewScanner(bytes.NewReader(chartsContent))
-	for scanner.Scan() {
-		reald = append(reald, scanner.Text())
+	if regenerated.Entries["frobnitz"][0].Digest == "sha256:stale" {
+		t.Error("Expected AppendDirectory to replace the stale entry")
 	}
-	sort.Strings(reald)
 
-	if strings.Join(expected, " ") != strings.Join(reald, " ") {
-		t.Errorf("Cached charts file content unexpected. Expected:\n%s\ngot:\n%s", expected, reald)
+	// Older clients load indices strictly and reject the extra field.
+	b, err = os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadBaselineIndex(b); err == nil || !strings.Contains(err.Error(), `unknown field "extra"`) {
+		t.Errorf("Expected older clients to reject extra fields, got %v", err)
 	}
 }
 
-func TestIndexDirectory(t *testing.T) {
+func TestMissingArchives(t *testing.T) {
 	dir := "testdata/repository"
 	index, err := IndexDirectory(dir, "http://localhost:8080")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if l := len(index.Entries); l != 3 {
-		t.Fatalf("Expected 3 entries, got %d", l)
-	}
-
-	// Other things test the entry generation more thoroughly. We just test a
-	// few fields.
-
-	corpus := []struct{ chartName, downloadLink string }{
-		{"frobnitz", "http://localhost:8080/frobnitz-1.2.3.tgz"},
-		{"zarthal", "http://localhost:8080/universe/zarthal-1.0.0.tgz"},
-	}
-
-	for _, test := range corpus {
-		cname := test.chartName
-		frobs, ok := index.Entries[cname]
-		if !ok {
-			t.Fatalf("Could not read chart %s", cname)
+	for _, md := range []*chart.Metadata{
+		{APIVersion: "v2", Name: "sprocket", Version: "9.9.9"},
+		{APIVersion: "v2", Name: "orphan", Version: "0.1.0"},
+	} {
+		if err := index.MustAdd(md, md.Name+"-"+md.Version+".tgz", "http://localhost:8080", "aaaa"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
 		}
+	}
+	index.Entries["nourl"] = ChartVersions{{Metadata: &chart.Metadata{Name: "nourl", Version: "0.1.0"}}}
 
-		frob := frobs[0]
-		if frob.Digest == "" {
-			t.Errorf("Missing digest of file %s.", frob.Name)
-		}
-		if frob.URLs[0] != test.downloadLink {
-			t.Errorf("Unexpected URLs: %v", frob.URLs)
-		}
-		if frob.Name != cname {
-			t.Errorf("Expected %q, got %q", cname, frob.Name)
-		}
+	missing := index.MissingArchives(dir)
+	expect := []ChartRef{{"orphan", "0.1.0"}, {"sprocket", "9.9.9"}}
+	if fmt.Sprint(missing) != fmt.Sprint(expect) {
+		t.Errorf("Expected %v, got %v", expect, missing)
 	}
 }
 
@@ -541,6 +3397,88 @@ func TestIndexAdd(t *testing.T) {
 	}
 }
 
+func TestWriteSignedFile(t *testing.T) {
+	const keyName = "helm-testing@helm.sh"
+	i, err := LoadIndexFile(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "index.yaml")
+	if err := i.WriteSignedFile(dest, 0644, "testdata/helm-test-key.secret", keyName); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open("testdata/helm-test-key.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ring, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(dest + ".prov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(ring, bytes.NewReader(b), bytes.NewReader(sig)); err != nil {
+		t.Errorf("Expected the signature to verify the written index: %s", err)
+	}
+
+	signed, err := i.Sign("testdata/helm-test-key.secret", keyName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(ring, bytes.NewReader(b), bytes.NewReader(signed)); err != nil {
+		t.Errorf("Expected Sign to sign the marshaled index: %s", err)
+	}
+
+	if _, err := i.Sign("testdata/helm-test-key.secret", "nobody@example.com"); err == nil {
+		t.Error("Expected an error for an unknown key")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	f, err := os.Open("testdata/helm-test-key.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ring, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring[0].Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	i := NewIndexFile()
+	i.PublicKeys = []string{armored.String()}
+	keyring, err := i.Keyring()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keyring) != 1 || keyring[0].PrimaryKey.KeyId != ring[0].PrimaryKey.KeyId {
+		t.Errorf("Expected the index key to be parsed, got %v", keyring)
+	}
+
+	i.PublicKeys = append(i.PublicKeys, "not a key")
+	if _, err := i.Keyring(); err == nil || !strings.Contains(err.Error(), "public key 1") {
+		t.Errorf("Expected an error naming the malformed key, got %v", err)
+	}
+}
+
 func TestIndexWrite(t *testing.T) {
 	i := NewIndexFile()
 	if err := i.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "clipper", Version: "0.1.0"}, "clipper-0.1.0.tgz", "http://example.com/charts", "sha256:1234567890"); err != nil {
@@ -580,6 +3518,84 @@ func TestIndexJSONWrite(t *testing.T) {
 	}
 }
 
+func TestIndexWriteTo(t *testing.T) {
+	var _ io.WriterTo = IndexFile{}
+
+	multiline := NewIndexFile()
+	multiline.Annotations = map[string]string{"note": "entries: {}\nis not the key"}
+	if err := multiline.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "poem", Version: "0.1.0", Annotations: map[string]string{"verse": "first line\n  second line\n"}}, "poem-0.1.0.tgz", "http://example.com", "aaaa"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := multiline.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "prose", Version: "0.1.0", Annotations: map[string]string{"changes": "First paragraph.\n\nSecond paragraph.\n"}}, "prose-0.1.0.tgz", "http://example.com", "cccc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := multiline.MustAdd(&chart.Metadata{APIVersion: "v2", Name: "needs: quoting", Version: "0.1.0"}, "quoting-0.1.0.tgz", "http://example.com", "bbbb"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	indices := map[string]*IndexFile{
+		"empty":     NewIndexFile(),
+		"multiline": multiline,
+	}
+	for _, file := range []string{testfile, annotationstestfile, chartmuseumtestfile} {
+		i, err := LoadIndexFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices[file] = i
+	}
+
+	for name, i := range indices {
+		t.Run(name, func(t *testing.T) {
+			expected, err := yaml.Marshal(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			n, err := i.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("Expected %d bytes reported, got %d", buf.Len(), n)
+			}
+			if buf.String() != string(expected) {
+				t.Errorf("Expected WriteTo to match yaml.Marshal\nexpected:\n%s\ngot:\n%s", expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestIndexWriteJSONL(t *testing.T) {
+	i, err := LoadIndexFile(unorderedTestfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := i.WriteJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry struct {
+			Chart   string `json:"chart"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON line %q: %s", scanner.Text(), err)
+		}
+		got = append(got, entry.Chart+"-"+entry.Version)
+	}
+
+	expect := "alpine-1.0.0 chartWithNoURL-1.0.0 nginx-0.2.0 nginx-0.1.0"
+	if strings.Join(got, " ") != expect {
+		t.Errorf("Expected %q, got %q", expect, strings.Join(got, " "))
+	}
+}
+
 func TestAddFileIndexEntriesNil(t *testing.T) {
 	i := NewIndexFile()
 	i.APIVersion = chart.APIVersionV1
@@ -17,12 +17,16 @@ limitations under the License.
 package repo // import "helm.sh/helm/v3/pkg/repo"
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"sigs.k8s.io/yaml"
+
+	"helm.sh/helm/v3/pkg/helmpath"
 )
 
 // File represents the repositories.yaml file
@@ -30,6 +34,15 @@ type File struct {
 	APIVersion   string    `json:"apiVersion"`
 	Generated    time.Time `json:"generated"`
 	Repositories []*Entry  `json:"repositories"`
+
+	// Mirrors maps a repository name to alternative URLs serving the same
+	// repository, in the order they should be tried when its URL cannot be
+	// reached.
+	Mirrors map[string][]string `json:"mirrors,omitempty"`
+
+	// Labels maps a repository name to labels, such as env=prod or
+	// team=platform, used to select groups of repositories.
+	Labels map[string]map[string]string `json:"labels,omitempty"`
 }
 
 // NewFile generates an empty repositories file.
@@ -94,6 +107,106 @@ func (r *File) Get(name string) *Entry {
 	return nil
 }
 
+// GetURLsForRepo returns the URL of the named repository followed by the URLs
+// of its mirrors, in the order they should be tried. It returns nil if there
+// is no repository with that name.
+func (r *File) GetURLsForRepo(name string) []string {
+	entry := r.Get(name)
+	if entry == nil {
+		return nil
+	}
+	urls := []string{entry.URL}
+	for _, m := range r.Mirrors[name] {
+		if m != "" && m != entry.URL {
+			urls = append(urls, m)
+		}
+	}
+	return urls
+}
+
+// KeysByLabel returns, in the order they are configured, the names of the
+// repositories whose label key is set to value. Repositories without labels
+// never match.
+func (r *File) KeysByLabel(key, value string) []string {
+	var names []string
+	for _, entry := range r.Repositories {
+		if entry == nil {
+			continue
+		}
+		if v, ok := r.Labels[entry.Name][key]; ok && v == value {
+			names = append(names, entry.Name)
+		}
+	}
+	return names
+}
+
+// RepoForArchiveURL returns the repository serving the chart archive at the
+// given URL.
+//
+// A repository serves an archive if the archive URL lies under its URL or the
+// URL of one of its mirrors. URLs are compared in the canonical form of
+// IndexFile.CanonicalizeURLs, and the query of the archive URL is ignored.
+// If several repositories match, the one with the longest URL path wins.
+func (r *File) RepoForArchiveURL(archiveURL string) (*Entry, error) {
+	target, err := url.Parse(canonicalURL(archiveURL))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid archive URL %q", archiveURL)
+	}
+
+	var found *Entry
+	longest := -1
+	for _, entry := range r.Repositories {
+		if entry == nil {
+			continue
+		}
+		for _, u := range r.GetURLsForRepo(entry.Name) {
+			base, err := url.Parse(canonicalURL(u))
+			if err != nil || base.Scheme != target.Scheme || base.Host != target.Host {
+				continue
+			}
+			prefix := strings.TrimSuffix(base.Path, "/") + "/"
+			if strings.HasPrefix(target.Path, prefix) && len(prefix) > longest {
+				found, longest = entry, len(prefix)
+			}
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("no repository found serving %s", archiveURL)
+	}
+	return found, nil
+}
+
+// CacheState describes the cached index of a configured repository.
+type CacheState struct {
+	// Cached is true when the cache file is a non-empty regular file that
+	// can be loaded without first running "helm repo update".
+	Cached bool
+	// CacheFileExists is true when anything exists at the cache file path.
+	CacheFileExists bool
+	// ModTime is the modification time of the cache file, if it exists.
+	ModTime time.Time
+}
+
+// CacheStatus reports, for each configured repository, whether its index has
+// been fetched into the cache directory at cachePath. The cache files are
+// only inspected with os.Stat; they are not loaded or parsed.
+func (r *File) CacheStatus(cachePath string) map[string]CacheState {
+	status := make(map[string]CacheState, len(r.Repositories))
+	for _, re := range r.Repositories {
+		if re == nil {
+			continue
+		}
+		var state CacheState
+		if fi, err := os.Stat(filepath.Join(cachePath, helmpath.CacheIndexFile(re.Name))); err == nil {
+			state.CacheFileExists = true
+			state.ModTime = fi.ModTime()
+			state.Cached = fi.Mode().IsRegular() && fi.Size() > 0
+		}
+		status[re.Name] = state
+	}
+	return status
+}
+
 // Remove removes the entry from the list of repositories.
 func (r *File) Remove(name string) bool {
 	cp := []*Entry{}
@@ -109,6 +222,8 @@ func (r *File) Remove(name string) bool {
 		cp = append(cp, rf)
 	}
 	r.Repositories = cp
+	delete(r.Mirrors, name)
+	delete(r.Labels, name)
 	return found
 }
 
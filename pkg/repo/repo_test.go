@@ -18,8 +18,11 @@ package repo
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"helm.sh/helm/v3/pkg/helmpath"
 )
 
 const testRepositoriesFile = "testdata/repositories.yaml"
@@ -255,3 +258,131 @@ func TestRemoveRepositoryInvalidEntries(t *testing.T) {
 		t.Errorf("repository %s not deleted", removeRepository)
 	}
 }
+
+func TestGetURLsForRepo(t *testing.T) {
+	rf := NewFile()
+	rf.Add(
+		&Entry{
+			Name: "stable",
+			URL:  "https://example.com/stable/charts",
+		},
+		&Entry{
+			Name: "incubator",
+			URL:  "https://example.com/incubator",
+		},
+	)
+
+	rf.Mirrors = map[string][]string{
+		"stable": {"https://mirror1.example.com/stable/charts", "https://mirror2.example.com/stable/charts"},
+	}
+
+	expect := "https://example.com/stable/charts https://mirror1.example.com/stable/charts https://mirror2.example.com/stable/charts"
+	if got := strings.Join(rf.GetURLsForRepo("stable"), " "); got != expect {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+	if got := rf.GetURLsForRepo("incubator"); len(got) != 1 || got[0] != "https://example.com/incubator" {
+		t.Errorf("Expected only the primary URL, got %v", got)
+	}
+	if got := rf.GetURLsForRepo("nosuchrepo"); got != nil {
+		t.Errorf("Expected nil for a missing repository, got %v", got)
+	}
+}
+
+func TestKeysByLabel(t *testing.T) {
+	rf := NewFile()
+	rf.Add(
+		&Entry{Name: "prod-apps", URL: "https://example.com/prod-apps"},
+		&Entry{Name: "staging", URL: "https://example.com/staging"},
+		&Entry{Name: "prod-infra", URL: "https://example.com/prod-infra"},
+		&Entry{Name: "unlabeled", URL: "https://example.com/unlabeled"},
+	)
+	rf.Labels = map[string]map[string]string{
+		"prod-apps":  {"env": "prod", "team": "apps"},
+		"staging":    {"env": "staging", "team": "apps"},
+		"prod-infra": {"env": "prod", "team": "platform"},
+	}
+
+	if got := strings.Join(rf.KeysByLabel("env", "prod"), ","); got != "prod-apps,prod-infra" {
+		t.Errorf("Expected prod-apps,prod-infra, got %s", got)
+	}
+	if got := strings.Join(rf.KeysByLabel("team", "apps"), ","); got != "prod-apps,staging" {
+		t.Errorf("Expected prod-apps,staging, got %s", got)
+	}
+	if got := rf.KeysByLabel("env", ""); got != nil {
+		t.Errorf("Expected no repositories with an empty env label, got %v", got)
+	}
+
+	rf.Remove("prod-apps")
+	if _, ok := rf.Labels["prod-apps"]; ok {
+		t.Error("Expected the labels of a removed repository to be removed")
+	}
+}
+
+func TestRepoForArchiveURL(t *testing.T) {
+	rf := NewFile()
+	rf.Add(
+		&Entry{Name: "example", URL: "https://example.com/charts"},
+		&Entry{Name: "nested", URL: "https://example.com/charts/nested/"},
+		&Entry{Name: "root", URL: "http://root.example.com"},
+	)
+	rf.Mirrors = map[string][]string{
+		"example": {"https://mirror.example.com/charts"},
+	}
+
+	for archiveURL, expect := range map[string]string{
+		"https://example.com/charts/foo-1.0.0.tgz":              "example",
+		"https://EXAMPLE.com:443/charts//foo-1.0.0.tgz?token=x": "example",
+		"https://example.com/charts/nested/bar-1.0.0.tgz":       "nested",
+		"https://mirror.example.com/charts/sub/foo-1.0.0.tgz":   "example",
+		"http://root.example.com/anything/at/all/baz-1.0.0.tgz": "root",
+	} {
+		entry, err := rf.RepoForArchiveURL(archiveURL)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", archiveURL, err)
+			continue
+		}
+		if entry.Name != expect {
+			t.Errorf("Expected %s to be served by %s, got %s", archiveURL, expect, entry.Name)
+		}
+	}
+
+	for _, archiveURL := range []string{
+		"https://example.com/chartsfoo-1.0.0.tgz",
+		"http://example.com/charts/foo-1.0.0.tgz",
+		"https://other.example.com/charts/foo-1.0.0.tgz",
+	} {
+		if entry, err := rf.RepoForArchiveURL(archiveURL); err == nil {
+			t.Errorf("Expected no repository for %s, got %s", archiveURL, entry.Name)
+		}
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	cachePath := t.TempDir()
+	rf := NewFile()
+	rf.Add(
+		&Entry{Name: "cached", URL: "https://example.com/cached"},
+		&Entry{Name: "empty", URL: "https://example.com/empty"},
+		&Entry{Name: "never", URL: "https://example.com/never"},
+	)
+	if err := os.WriteFile(filepath.Join(cachePath, helmpath.CacheIndexFile("cached")), []byte("apiVersion: v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cachePath, helmpath.CacheIndexFile("empty")), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	status := rf.CacheStatus(cachePath)
+	if len(status) != 3 {
+		t.Fatalf("Expected 3 repositories, got %d", len(status))
+	}
+	if s := status["cached"]; !s.Cached || !s.CacheFileExists || s.ModTime.IsZero() {
+		t.Errorf("Expected cached to be cached, got %+v", s)
+	}
+	if s := status["empty"]; s.Cached || !s.CacheFileExists {
+		t.Errorf("Expected empty to exist but not be cached, got %+v", s)
+	}
+	if s := status["never"]; s.Cached || s.CacheFileExists || !s.ModTime.IsZero() {
+		t.Errorf("Expected never to have no cache file, got %+v", s)
+	}
+}